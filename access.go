@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dice_room/model"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// accessCookie holds a signed token that lets its holder into a room with a passphrase.
+	accessCookie = "access"
+	// accessTTL is how long a passphrase or invite keeps a browser in a room.
+	accessTTL = 30 * 24 * time.Hour
+	// inviteTTL is how long an invite link works for.
+	inviteTTL = 7 * 24 * time.Hour
+
+	passphraseIterations = 600_000
+	passphraseKeyLength  = 32
+)
+
+// Token kinds, so that an invite can not be used as an access cookie or the
+// other way around.
+const (
+	tokenAccess = "access"
+	tokenInvite = "invite"
+)
+
+// roomToken is the signed payload of an invite link or access cookie.
+type roomToken struct {
+	Kind    string `json:"k"`
+	Room    string `json:"r"`
+	Expires int64  `json:"e"`
+}
+
+// hashPassphrase hashes a room passphrase for storage as
+// "pbkdf2-sha256$iterations$salt$key".
+func hashPassphrase(passphrase string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, passphraseIterations, passphraseKeyLength)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passphraseIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassphrase reports whether passphrase matches a hash from hashPassphrase.
+func checkPassphrase(hash, passphrase string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// roomToken signs a token of the given kind for a room, valid for ttl.
+func (s *Server) roomToken(kind, roomID string, ttl time.Duration) (string, error) {
+	return s.signer.Sign(roomToken{Kind: kind, Room: roomID, Expires: time.Now().Add(ttl).Unix()})
+}
+
+// validRoomToken reports whether token is an unexpired token of the given kind for the room.
+func (s *Server) validRoomToken(token, kind, roomID string) bool {
+	var t roomToken
+	if err := s.signer.Verify(token, &t); err != nil {
+		return false
+	}
+	return t.Kind == kind && t.Room == roomID && time.Now().Unix() < t.Expires
+}
+
+// canEnter reports whether the request may see and roll in the room. Rooms
+// without a passphrase are open to anyone with the link; the rest need the
+// GM's key or an access cookie from the passphrase or an invite.
+func (s *Server) canEnter(r *http.Request, room *model.Room) bool {
+	if room.Passphrase == "" || isGM(r, room) {
+		return true
+	}
+	cookie, err := r.Cookie(accessCookie)
+	if err != nil {
+		return false
+	}
+	return s.validRoomToken(cookie.Value, tokenAccess, room.Id)
+}
+
+// grantAccess gives the browser an access cookie for the room.
+func (s *Server) grantAccess(w http.ResponseWriter, r *http.Request, roomID string) error {
+	token, err := s.roomToken(tokenAccess, roomID, accessTTL)
+	if err != nil {
+		return err
+	}
+	s.setRoomCookie(w, r, roomID, accessCookie, token)
+	return nil
+}
+
+// inviteLink is the path of a fresh invite link to the room.
+func (s *Server) inviteLink(r *http.Request, roomID string) (string, error) {
+	token, err := s.roomToken(tokenInvite, roomID, inviteTTL)
+	if err != nil {
+		return "", err
+	}
+	return s.prefixFor(r) + "/room/" + roomID + "?invite=" + url.QueryEscape(token), nil
+}
+
+// gateRoom lets a browser into a room with a passphrase: it takes invite links
+// and the passphrase form, and shows everyone else the locked page. It reports
+// whether the request may go on to the room; if not, it has responded.
+func (s *Server) gateRoom(w http.ResponseWriter, r *http.Request, room *model.Room) bool {
+	if room.Passphrase == "" {
+		return true
+	}
+	if invite := r.URL.Query().Get("invite"); invite != "" {
+		if !s.validRoomToken(invite, tokenInvite, room.Id) {
+			s.renderLocked(w, r, room, "This invite link is invalid or has expired. Ask the GM for a new one.")
+			return false
+		}
+		if err := s.grantAccess(w, r, room.Id); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return false
+		}
+		// Drop the token from the address bar so it is not shared by accident.
+		http.Redirect(w, r, s.prefixFor(r)+"/room/"+room.Id, http.StatusSeeOther)
+		return false
+	}
+	if s.canEnter(r, room) {
+		return true
+	}
+	if r.Method == http.MethodPost && r.FormValue("action") == "unlock" {
+		// Guesses are slow to check on purpose, so they are limited too.
+		if ok, wait := s.limits.unlock.Allow(s.limits.clientIP(r)); !ok {
+			tooManyRequests(w, wait)
+			return false
+		}
+		if !checkPassphrase(room.Passphrase, r.FormValue("passphrase")) {
+			s.renderLocked(w, r, room, "Wrong passphrase.")
+			return false
+		}
+		if err := s.grantAccess(w, r, room.Id); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return false
+		}
+		http.Redirect(w, r, s.prefixFor(r)+"/room/"+room.Id, http.StatusSeeOther)
+		return false
+	}
+	s.renderLocked(w, r, room, "")
+	return false
+}
+
+func (s *Server) renderLocked(w http.ResponseWriter, r *http.Request, room *model.Room, message string) {
+	page, err := s.formPage(w, r)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+	data := model.LockedData{
+		PageData: page,
+		ID:       room.Id,
+		Error:    message,
+	}
+	s.templates.ExecuteTemplate(w, "locked.html", data)
+}
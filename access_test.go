@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassphraseHashRoundTrip(t *testing.T) {
+	hash, err := hashPassphrase("open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hash, "open sesame") {
+		t.Fatalf("hash %q holds the passphrase", hash)
+	}
+	if !checkPassphrase(hash, "open sesame") {
+		t.Error("right passphrase rejected")
+	}
+	for _, wrong := range []string{"", "open sesam", "Open sesame"} {
+		if checkPassphrase(hash, wrong) {
+			t.Errorf("wrong passphrase %q accepted", wrong)
+		}
+	}
+	if checkPassphrase("", "") {
+		t.Error("empty hash accepted")
+	}
+}
+
+func TestRoomTokensAreBoundToKindRoomAndTime(t *testing.T) {
+	s := &Server{signer: NewSigner([]byte("secret"))}
+	invite, err := s.roomToken(tokenInvite, "r1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.validRoomToken(invite, tokenInvite, "r1") {
+		t.Error("fresh invite rejected")
+	}
+	if s.validRoomToken(invite, tokenAccess, "r1") {
+		t.Error("invite accepted as an access token")
+	}
+	if s.validRoomToken(invite, tokenInvite, "r2") {
+		t.Error("invite accepted for another room")
+	}
+
+	expired, _ := s.roomToken(tokenInvite, "r1", -time.Second)
+	if s.validRoomToken(expired, tokenInvite, "r1") {
+		t.Error("expired invite accepted")
+	}
+
+	other := &Server{signer: NewSigner([]byte("other secret"))}
+	if other.validRoomToken(invite, tokenInvite, "r1") {
+		t.Error("invite signed with another key accepted")
+	}
+	payload, sig, _ := strings.Cut(invite, ".")
+	if s.validRoomToken(payload+"x."+sig, tokenInvite, "r1") {
+		t.Error("tampered invite accepted")
+	}
+}
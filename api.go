@@ -0,0 +1,268 @@
+package main
+
+import (
+	"dice_room/dice"
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAPIBody caps the size of a JSON request body.
+const maxAPIBody = 64 << 10
+
+// maxRollsLimit caps the page size a client may ask for.
+const maxRollsLimit = 200
+
+// apiRoom is the public view of a room. It never carries the secret server seed.
+type apiRoom struct {
+	Id         string            `json:"id"`
+	Name       string            `json:"name"`
+	SeedHash   string            `json:"seedHash,omitempty"`
+	CustomDice []model.CustomDie `json:"customDice,omitempty"`
+}
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type createRoomRequest struct {
+	Name string `json:"name"`
+}
+
+// createRollRequest is a roll to make. A caller with a player session rolls
+// as that player; anyone else must give a name in User, and their roll is
+// marked as made through the API.
+type createRollRequest struct {
+	User       string `json:"user"`
+	Expression string `json:"expression"`
+	Desc       string `json:"desc"`
+	ClientSeed string `json:"clientSeed"`
+}
+
+type rollsResponse struct {
+	Rolls []model.LogEntry `json:"rolls"`
+	// NextBefore is the cursor for the next, older page; absent on the last page.
+	NextBefore int64 `json:"nextBefore,omitempty"`
+}
+
+// apiRoutes registers the versioned JSON API on mux.
+func (s *Server) apiRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/rooms", s.apiCreateRoom)
+	mux.HandleFunc("GET /api/v1/rooms/{id}", s.apiGetRoom)
+	mux.HandleFunc("POST /api/v1/rooms/{id}/rolls", s.apiCreateRoll)
+	mux.HandleFunc("GET /api/v1/rooms/{id}/rolls", s.apiListRolls)
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("api: encode response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{Error: apiErrorBody{Code: code, Message: message}})
+}
+
+// writeRateLimited tells an API client to slow down.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfter(wait))
+	writeAPIError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, retry after "+retryAfter(wait)+"s")
+}
+
+// writeStoreError maps store errors onto API errors.
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrRoomNotFound) {
+		writeAPIError(w, http.StatusNotFound, "room_not_found", err.Error())
+		return
+	}
+	log.Printf("api: store error: %v", err)
+	writeAPIError(w, http.StatusInternalServerError, "internal", "internal error")
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *Server) toAPIRoom(room *model.Room) apiRoom {
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+	out := apiRoom{Id: room.Id, Name: room.RoomName, CustomDice: room.CustomDice}
+	if seed := s.currentSeed(room); seed != nil {
+		out.SeedHash = seed.Hash
+	}
+	return out
+}
+
+func (s *Server) apiCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if ok, wait := s.limits.createRoom.Allow(s.limits.clientIP(r)); !ok {
+		writeRateLimited(w, wait)
+		return
+	}
+	var req createRoomRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	// Rooms made through the API have no GM.
+	room, err := s.store.CreateRoom(strings.TrimSpace(req.Name), s.newRoomSeed(), "", "")
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.toAPIRoom(room))
+}
+
+// apiRoom loads the room named in the path and who the request comes from,
+// if they may enter it. Otherwise it has responded.
+func (s *Server) apiRoom(w http.ResponseWriter, r *http.Request) (*model.Room, model.Viewer, bool) {
+	room, err := s.store.GetRoom(r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, model.Viewer{}, false
+	}
+	if !s.canEnter(r, room) {
+		writeAPIError(w, http.StatusForbidden, "room_locked", "this room needs a passphrase or an invite")
+		return nil, model.Viewer{}, false
+	}
+	viewer, ok, err := s.admit(r, room)
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, model.Viewer{}, false
+	}
+	if !ok {
+		writeAPIError(w, http.StatusForbidden, "banned", "you are banned from this room")
+		return nil, model.Viewer{}, false
+	}
+	return room, viewer, true
+}
+
+func (s *Server) apiGetRoom(w http.ResponseWriter, r *http.Request) {
+	room, _, ok := s.apiRoom(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.toAPIRoom(room))
+}
+
+func (s *Server) apiCreateRoll(w http.ResponseWriter, r *http.Request) {
+	room, viewer, ok := s.apiRoom(w, r)
+	if !ok {
+		return
+	}
+	var req createRollRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	player := viewer
+	if player.PlayerID == "" {
+		player.Name = strings.TrimSpace(req.User)
+		if player.Name == "" {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "user is required without a player session")
+			return
+		}
+	}
+	if req.Expression == "" {
+		req.Expression = "d20"
+	}
+	if ok, wait := s.limits.allowRoll(s.limits.clientIP(r), room.Id); !ok {
+		writeRateLimited(w, wait)
+		return
+	}
+
+	entry, err := s.rollDice(room, player, req.Expression, req.Desc, req.ClientSeed, model.VisibilityPublic)
+	if err != nil {
+		if errors.Is(err, dice.ErrInvalidExpression) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_expression", err.Error())
+		} else {
+			writeStoreError(w, err)
+		}
+		return
+	}
+	s.broadcastEntry(room.Id, entry)
+	writeJSON(w, http.StatusCreated, entry)
+}
+
+// apiListRolls pages through the room's rolls newest first: ?limit=<n> sets
+// the page size and ?before=<seq> continues from a previous page's nextBefore.
+// With ?since=<unixMillis> it instead returns every roll made after that
+// instant, oldest first, for polling. Secret and whispered rolls are shown
+// only as the room's cookies sent with the request allow.
+func (s *Server) apiListRolls(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, ok := queryInt(w, query.Get("since"), "since must be a unix time in milliseconds")
+	if !ok {
+		return
+	}
+	before, ok := queryInt(w, query.Get("before"), "before must be a roll seq")
+	if !ok {
+		return
+	}
+	limit, ok := queryInt(w, query.Get("limit"), "limit must be a number")
+	if !ok {
+		return
+	}
+	if limit <= 0 || limit > maxRollsLimit {
+		limit = roomPageSize
+	}
+
+	room, viewer, ok := s.apiRoom(w, r)
+	if !ok {
+		return
+	}
+	roomID := room.Id
+	if since > 0 {
+		rolls, err := rollsUntil(s.store, roomID, func(e model.LogEntry) bool { return e.UnixMillis <= since })
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rollsResponse{Rolls: showAll(viewer, rolls)})
+		return
+	}
+
+	rolls, err := s.store.RecentRolls(roomID, before, int(limit))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	resp := rollsResponse{Rolls: showAll(viewer, rolls)}
+	if len(rolls) == int(limit) {
+		resp.NextBefore = rolls[len(rolls)-1].Seq
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// queryInt parses an optional integer query parameter, writing a 400 with
+// message if it is malformed. An absent parameter is 0.
+func queryInt(w http.ResponseWriter, v, message string) (int64, bool) {
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", message)
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"dice_room/dice"
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testServer is a server over st with a local broadcaster and no rate limits.
+func testServer(st store.Store) *Server {
+	b := NewLocalBroadcaster(StreamConfig{})
+	return NewServer(st, b, NewPresence(b, 0), NewSigner([]byte("test secret")), NewLimits(LimitConfig{}), dice.NewSeededRoller(1), "", false)
+}
+
+func TestAPIRollsAsTheSessionOrAsALabelledName(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := testServer(st)
+	room, err := st.CreateRoom("r", dice.NewServerSeed(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := s.setSession(rec, httptest.NewRequest("GET", "/room/"+room.Id, nil), session{Room: room.Id, Player: "p1", Name: "ann"}); err != nil {
+		t.Fatal(err)
+	}
+	sessionCookies := rec.Result().Cookies()
+
+	roll := func(body string, withSession bool) int {
+		req := httptest.NewRequest("POST", "/api/v1/rooms/"+room.Id+"/rolls", strings.NewReader(body))
+		if withSession {
+			for _, c := range sessionCookies {
+				req.AddCookie(c)
+			}
+		}
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	newest := func() (user, player string, api bool) {
+		rolls, err := st.RecentRolls(room.Id, 0, 1)
+		if err != nil || len(rolls) != 1 {
+			t.Fatalf("newest roll: %+v, %v", rolls, err)
+		}
+		return rolls[0].User, rolls[0].PlayerID, rolls[0].API
+	}
+
+	// A player's session decides who rolls, whatever name the body gives.
+	if code := roll(`{"user":"bob","expression":"d6"}`, true); code != http.StatusCreated {
+		t.Fatalf("roll with a session: status %d", code)
+	}
+	if user, player, api := newest(); user != "ann" || player != "p1" || api {
+		t.Errorf("roll with a session is by %q (%q, api %v), want ann (p1)", user, player, api)
+	}
+
+	// Without one, the name given is kept but belongs to no player.
+	if code := roll(`{"user":"ann","expression":"d6"}`, false); code != http.StatusCreated {
+		t.Fatalf("roll without a session: status %d", code)
+	}
+	if user, player, api := newest(); user != "ann" || player != "" || !api {
+		t.Errorf("roll without a session is by %q (%q, api %v), want an API roll by ann", user, player, api)
+	}
+	if code := roll(`{"expression":"d6"}`, false); code != http.StatusBadRequest {
+		t.Errorf("roll with neither a session nor a name: status %d, want 400", code)
+	}
+}
+
+func TestSeededRollerDecidesEveryRoll(t *testing.T) {
+	roll := func() model.LogEntry {
+		s := testServer(store.NewMemoryStore())
+		do := func(path, body string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			s.routes().ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("POST %s: status %d: %s", path, rec.Code, rec.Body)
+			}
+			return rec
+		}
+		var room apiRoom
+		if err := json.NewDecoder(do("/api/v1/rooms", `{"name":"r"}`).Body).Decode(&room); err != nil {
+			t.Fatal(err)
+		}
+		if room.SeedHash != "" {
+			t.Errorf("room made with a seeded roller has seed hash %q", room.SeedHash)
+		}
+		var entry model.LogEntry
+		if err := json.NewDecoder(do("/api/v1/rooms/"+room.Id+"/rolls", `{"user":"ann","expression":"10d20"}`).Body).Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Proof != nil {
+			t.Errorf("roll made with a seeded roller has proof %+v", entry.Proof)
+		}
+		return entry
+	}
+
+	first, second := roll(), roll()
+	if !reflect.DeepEqual(first.Groups, second.Groups) || first.Result != second.Result {
+		t.Errorf("rolls with the same roller seed differ: %+v and %+v", first.Groups, second.Groups)
+	}
+}
+
+func TestConcurrentFairRollsGetTheirOwnNonces(t *testing.T) {
+	st := store.NewMemoryStore()
+	b := NewLocalBroadcaster(StreamConfig{})
+	s := NewServer(st, b, NewPresence(b, 0), NewSigner([]byte("test secret")), NewLimits(LimitConfig{}), dice.CryptoRoller{}, "", false)
+	room, err := st.CreateRoom("r", dice.NewServerSeed(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const rolls = 50
+	var wg sync.WaitGroup
+	for range rolls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.rollDice(room, model.Viewer{Name: "ann", PlayerID: "p1"}, "d20", "", "same", model.VisibilityPublic); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := st.RecentRolls(room.Id, 0, rolls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonces := make(map[int]bool)
+	for _, e := range entries {
+		if e.Proof == nil || int64(e.Proof.Nonce) != e.Seq || nonces[e.Proof.Nonce] {
+			t.Errorf("roll %d has proof %+v, want its own nonce", e.Seq, e.Proof)
+			continue
+		}
+		nonces[e.Proof.Nonce] = true
+	}
+	if len(nonces) != rolls {
+		t.Errorf("%d distinct nonces, want %d", len(nonces), rolls)
+	}
+}
@@ -4,14 +4,37 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// storeBackends are the values accepted by --store.
+var storeBackends = []string{"memory", "bullet", "sqlite"}
+
+// broadcastBackends are the values accepted by --broadcast.
+var broadcastBackends = []string{"local", "poll"}
+
 type Args struct {
-	Port       int
-	BulletPort int
-	HostPrefix string
-	Dev        bool
+	Port          int
+	BulletPort    int
+	HostPrefix    string
+	Dev           bool
+	Roller        string
+	Seed          uint64
+	Store         string
+	DbPath        string
+	Stream        StreamConfig
+	Broadcast     string
+	PollEvery     time.Duration
+	PresenceGrace time.Duration
+	// Secret signs sessions, invite links and access cookies. Empty means a
+	// random one per run.
+	Secret string
+	// OldSecrets are retired secrets whose signatures are still accepted.
+	OldSecrets []string
+	Limits     LimitConfig
 }
 
 func ReadArgs() (*Args, error) {
@@ -20,24 +43,59 @@ func ReadArgs() (*Args, error) {
 	port := flag.String("port", "", "port number to run on")
 	hostPrefix := flag.String("hostPrefix", "", "the /tbc/dice_room component of the url which is needed because firbolg_gateway trims it down.")
 	dev := flag.Bool("dev", false, "dev mode: disables Secure flag on cookies so the site works over plain HTTP on localhost")
+	roller := flag.String("roller", "crypto", "source of dice randomness: crypto, or seeded for reproducible rolls in tests and replays")
+	seed := flag.Uint64("seed", 0, "seed for --roller=seeded")
+	storeKind := flag.String("store", "bullet", "storage backend: "+strings.Join(storeBackends, ", "))
+	dbPath := flag.String("dbPath", "", "path of the sqlite database file for --store=sqlite")
+	sseBuffer := flag.Int("sseBuffer", defaultSubscriberBuffer, "events a live room stream may fall behind by before it is cut off and told to resync")
+	sseHeartbeat := flag.Duration("sseHeartbeat", defaultHeartbeat, "interval between keep-alive comments on quiet room streams; keep it under the proxy's idle timeout")
+	sseRetry := flag.Duration("sseRetry", defaultRetry, "reconnect delay suggested to browsers when a room stream ends")
+	broadcast := flag.String("broadcast", "local", "live update backend: local for a single instance, or poll to share live events between instances on the same store")
+	pollEvery := flag.Duration("pollEvery", defaultPollInterval, "how often --broadcast=poll checks the store for other instances' events")
+	sseMaxLifetime := flag.Duration("sseMaxLifetime", defaultMaxLifetime, "longest a room stream stays open before the browser is made to reconnect")
+	secret := flag.String("secret", os.Getenv("DICE_ROOM_SECRET"), "key that signs player sessions, invite links and access cookies; defaults to $DICE_ROOM_SECRET. Every instance sharing a store needs the same one")
+	oldSecrets := flag.String("oldSecrets", os.Getenv("DICE_ROOM_OLD_SECRETS"), "comma separated retired secrets still accepted while a rotation rolls out; defaults to $DICE_ROOM_OLD_SECRETS")
+	sseMaxPerRoom := flag.Int("sseMaxPerRoom", defaultMaxPerRoom, "most live streams one room may have open on this instance")
+	limitCreateRoom := flag.String("limitCreateRoom", "10/1h", "rooms each client may create, as events/duration, or off")
+	limitRoll := flag.String("limitRoll", "60/1m", "rolls each client may make across rooms, as events/duration, or off")
+	limitRoomRoll := flag.String("limitRoomRoll", "120/1m", "rolls each room takes from all its players, as events/duration, or off")
+	limitUnlock := flag.String("limitUnlock", "10/1m", "room passphrase guesses each client may make, as events/duration, or off")
+	trustedProxies := flag.String("trustedProxies", "127.0.0.1,::1", "comma separated IPs and CIDRs of the proxies whose X-Forwarded-For names the client")
+	presenceGrace := flag.Duration("presenceGrace", defaultPresenceGrace, "how long a player can be disconnected before the room is told they left; keep it above sseRetry")
 
 	flag.Parse()
-	if *internalBulletPort == "" {
-		return nil, errors.New("missing internal bullet port")
-	}
 
 	fmt.Println("hostPrefix (used for redirects to /room) for this session is " + *hostPrefix)
 
 	if *port == "" {
 		return nil, errors.New("missing port")
 	}
-	internalBulletPortInt, err := strconv.Atoi(*internalBulletPort)
 
-	if err != nil {
-		fmt.Println("Invalid internalBulletPort port :", internalBulletPort)
-		return nil, err
+	// Backend specific flags are only checked for the backend in use.
+	args.Store = *storeKind
+	switch args.Store {
+	case "memory":
+		fmt.Println("WARNING: memory store enabled — rooms are lost when the process exits")
+	case "bullet":
+		if *internalBulletPort == "" {
+			return nil, errors.New("missing internal bullet port")
+		}
+		internalBulletPortInt, err := strconv.Atoi(*internalBulletPort)
+
+		if err != nil {
+			fmt.Println("Invalid internalBulletPort port :", internalBulletPort)
+			return nil, err
+		}
+		fmt.Println("Bullet port is " + strconv.Itoa(internalBulletPortInt))
+		args.BulletPort = internalBulletPortInt
+	case "sqlite":
+		if *dbPath == "" {
+			return nil, errors.New("missing dbPath for sqlite store")
+		}
+		args.DbPath = *dbPath
+	default:
+		return nil, errors.New("store must be one of " + strings.Join(storeBackends, ", "))
 	}
-	fmt.Println("Bullet port (unused is " + strconv.Itoa(internalBulletPortInt))
 
 	portInt, err := strconv.Atoi(*port)
 	if err != nil {
@@ -45,9 +103,78 @@ func ReadArgs() (*Args, error) {
 		return nil, err
 	}
 	args.Port = portInt
-	args.BulletPort = internalBulletPortInt
 	args.HostPrefix = *hostPrefix
 	args.Dev = *dev
+	if *roller != "crypto" && *roller != "seeded" {
+		return nil, errors.New("roller must be crypto or seeded")
+	}
+	args.Roller = *roller
+	args.Seed = *seed
+	if *sseBuffer < 1 {
+		return nil, errors.New("sseBuffer must be at least 1")
+	}
+	if *sseHeartbeat <= 0 || *sseRetry <= 0 || *sseMaxLifetime <= 0 {
+		return nil, errors.New("sseHeartbeat, sseRetry and sseMaxLifetime must be positive")
+	}
+	if *sseMaxPerRoom < 1 {
+		return nil, errors.New("sseMaxPerRoom must be at least 1")
+	}
+	switch *broadcast {
+	case "local":
+	case "poll":
+		if *pollEvery <= 0 {
+			return nil, errors.New("pollEvery must be positive")
+		}
+		if args.Store == "memory" {
+			fmt.Println("WARNING: --broadcast=poll with the memory store only shares events within this instance")
+		}
+	default:
+		return nil, errors.New("broadcast must be one of " + strings.Join(broadcastBackends, ", "))
+	}
+	args.Broadcast = *broadcast
+	args.PollEvery = *pollEvery
+	args.Stream = StreamConfig{
+		Buffer:      *sseBuffer,
+		Heartbeat:   *sseHeartbeat,
+		Retry:       *sseRetry,
+		MaxLifetime: *sseMaxLifetime,
+		MaxPerRoom:  *sseMaxPerRoom,
+	}
+	for _, limit := range []struct {
+		value string
+		into  *Rate
+	}{
+		{*limitCreateRoom, &args.Limits.CreateRoom},
+		{*limitRoll, &args.Limits.Roll},
+		{*limitRoomRoll, &args.Limits.RoomRoll},
+		{*limitUnlock, &args.Limits.Unlock},
+	} {
+		if *limit.into, err = ParseRate(limit.value); err != nil {
+			return nil, err
+		}
+	}
+	if args.Limits.TrustedProxies, err = ParseProxies(*trustedProxies); err != nil {
+		return nil, fmt.Errorf("trustedProxies: %w", err)
+	}
+	if *presenceGrace <= 0 {
+		return nil, errors.New("presenceGrace must be positive")
+	}
+	args.PresenceGrace = *presenceGrace
+	args.Secret = *secret
+	for _, old := range strings.Split(*oldSecrets, ",") {
+		if old = strings.TrimSpace(old); old != "" {
+			args.OldSecrets = append(args.OldSecrets, old)
+		}
+	}
+	if args.Secret == "" {
+		if len(args.OldSecrets) > 0 {
+			return nil, errors.New("oldSecrets needs a current secret")
+		}
+		fmt.Println("WARNING: no --secret set — player sessions, invite links and room access end when the process exits")
+	}
+	if args.Roller == "seeded" {
+		fmt.Println("WARNING: seeded roller enabled — rolls are predictable and not provably fair, do not use in production")
+	}
 	if args.Dev {
 		fmt.Println("WARNING: dev mode enabled — cookies are not Secure, do not use in production")
 	}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"dice_room/model"
+	"errors"
+	"strings"
+	"time"
+)
+
+// maxChatLength caps a chat message, in characters.
+const maxChatLength = 500
+
+// errEmptyChat is returned for a chat message with nothing to say.
+var errEmptyChat = errors.New("chat message is empty")
+
+// cleanChat trims a chat message and cuts it to maxChatLength characters.
+func cleanChat(text string) string {
+	text = strings.TrimSpace(text)
+	if r := []rune(text); len(r) > maxChatLength {
+		text = strings.TrimSpace(string(r[:maxChatLength]))
+	}
+	return text
+}
+
+// sendChat says text to the room as viewer. Chat goes to whoever is
+// connected and is not stored.
+func (s *Server) sendChat(roomID string, viewer model.Viewer, text string) error {
+	text = cleanChat(text)
+	if text == "" {
+		return errEmptyChat
+	}
+	now := time.Now()
+	ev, err := newEvent(model.RoomEvent{
+		Type:   model.EventChat,
+		RoomID: roomID,
+		Payload: model.ChatPayload{
+			User:       viewer.Name,
+			Text:       text,
+			Time:       now.Format("15:04:05"),
+			UnixMillis: now.UnixMilli(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	s.broadcaster.Send(roomID, ev)
+	return nil
+}
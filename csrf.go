@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"dice_room/model"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// csrfCookie holds the browser's random CSRF id for as long as it is open.
+	csrfCookie = "csrf"
+	// csrfField is the form field every post carries the signed id in.
+	csrfField = "csrf"
+)
+
+var (
+	errCrossOrigin = errors.New("form posted from another site")
+	errCSRFToken   = errors.New("missing or invalid form token")
+)
+
+// csrfClaim is the signed payload of a form token.
+type csrfClaim struct {
+	ID string `json:"c"`
+}
+
+func newCSRFID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// csrfToken is the token for the forms on a page. The browser's CSRF id lives
+// in a cookie another site can neither read nor, without our key, sign, so a
+// post carrying the signed id must come from a page we rendered. The cookie is
+// set here the first time.
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	id := ""
+	if cookie, err := r.Cookie(csrfCookie); err == nil {
+		id = cookie.Value
+	}
+	if id == "" {
+		var err error
+		if id, err = newCSRFID(); err != nil {
+			return "", err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    id,
+			Path:     s.prefixFor(r) + "/",
+			HttpOnly: true,
+			Secure:   s.secureCookies,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return s.signer.Sign(csrfClaim{ID: id})
+}
+
+// formPage is the PageData for a page with forms that post back to us.
+func (s *Server) formPage(w http.ResponseWriter, r *http.Request) (model.PageData, error) {
+	token, err := s.csrfToken(w, r)
+	if err != nil {
+		return model.PageData{}, err
+	}
+	return model.PageData{HostPrefix: s.prefixFor(r), CSRF: token}, nil
+}
+
+// requestHost is the host the browser asked for, which the gateway passes on
+// as X-Forwarded-Host.
+func requestHost(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	return r.Host
+}
+
+// sameOrigin reports whether a request came from one of our own pages.
+// Browsers send Origin with posts and WebSocket handshakes; older ones send
+// only a Referer, which must also be under the prefix this instance is served
+// at, so another app behind the same gateway host can not pass for us.
+// Requests with neither are let through to the token check.
+func (s *Server) sameOrigin(r *http.Request) bool {
+	host := requestHost(r)
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == host
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		u, err := url.Parse(referer)
+		if err != nil || u.Host != host {
+			return false
+		}
+		prefix := s.prefixFor(r)
+		return u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/")
+	}
+	return true
+}
+
+// checkCSRF reports why a form post may not be trusted, or nil.
+func (s *Server) checkCSRF(r *http.Request) error {
+	if !s.sameOrigin(r) {
+		return errCrossOrigin
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return errCSRFToken
+	}
+	var claim csrfClaim
+	if err := s.signer.Verify(r.PostFormValue(csrfField), &claim); err != nil {
+		return errCSRFToken
+	}
+	if subtle.ConstantTimeCompare([]byte(claim.ID), []byte(cookie.Value)) != 1 {
+		return errCSRFToken
+	}
+	return nil
+}
+
+// requireCSRF rejects form posts that did not come from our own pages.
+func (s *Server) requireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := s.checkCSRF(r); err != nil {
+				log.Printf("csrf: %s %s: %v", r.Method, r.URL.Path, err)
+				http.Error(w, "This form has expired. Reload the page and try again.", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
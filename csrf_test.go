@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireCSRF(t *testing.T) {
+	s := &Server{signer: NewSigner([]byte("secret")), hostPrefix: "/tbc/dice_room"}
+	// Render a page to get the browser's cookie and the token its forms carry.
+	page := httptest.NewRecorder()
+	token, err := s.csrfToken(page, httptest.NewRequest("GET", "http://example.com/tbc/dice_room/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := page.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || cookies[0].Path != "/tbc/dice_room/" {
+		t.Fatalf("cookies = %v, want one %s cookie on the prefix", cookies, csrfCookie)
+	}
+	other, _ := NewSigner([]byte("guess")).Sign(csrfClaim{ID: cookies[0].Value})
+
+	handler := s.requireCSRF(func(w http.ResponseWriter, r *http.Request) {})
+	for name, tc := range map[string]struct {
+		token   string
+		cookie  bool
+		headers map[string]string
+		want    int
+	}{
+		"same origin":       {token, true, map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		"no origin headers": {token, true, nil, http.StatusOK},
+		"referer in prefix": {token, true, map[string]string{"Referer": "http://example.com/tbc/dice_room/room/abc"}, http.StatusOK},
+		"forwarded prefix": {token, true, map[string]string{
+			"Referer":            "http://example.com/dice/room/abc",
+			"X-Forwarded-Prefix": "/dice",
+		}, http.StatusOK},
+		"forwarded host": {token, true, map[string]string{
+			"Origin":           "https://dice.example.org",
+			"X-Forwarded-Host": "dice.example.org",
+		}, http.StatusOK},
+		"no token":               {"", true, nil, http.StatusForbidden},
+		"no cookie":              {token, false, nil, http.StatusForbidden},
+		"token signed elsewhere": {other, true, nil, http.StatusForbidden},
+		"other site":             {token, true, map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		"null origin":            {token, true, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		"referer outside prefix": {token, true, map[string]string{"Referer": "http://example.com/tbc/other_app/"}, http.StatusForbidden},
+	} {
+		form := url.Values{"action": {"roll"}}
+		if tc.token != "" {
+			form.Set(csrfField, tc.token)
+		}
+		req := httptest.NewRequest("POST", "http://example.com/tbc/dice_room/room/abc", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.cookie {
+			req.AddCookie(cookies[0])
+		}
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package dice
+
+import (
+	"dice_room/model"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxCustomFaces     = 100
+	MaxFaceLabelLength = 30
+)
+
+// StandardDice are the dice offered in every room's picker, in display order.
+var StandardDice = []string{"d20", "d4", "d6", "d8", "d10", "d12", "d100", "d%", "dF"}
+
+var fudgeFaces = []model.Face{
+	{Label: "-", Value: -1},
+	{Label: "0", Value: 0},
+	{Label: "+", Value: 1},
+}
+
+var customNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,19}$`)
+
+// ParseCustomDie builds a custom die from a name and a comma separated list of
+// faces. Each face is "label" or "label=value"; a bare label is worth its
+// position, so "Head, Torso, Arm" behaves like a d3 with names on it.
+func ParseCustomDie(name string, faces string) (*model.CustomDie, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !customNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: die names are 1-20 letters, digits, - or _ and start with a letter", ErrInvalidExpression)
+	}
+	die := model.CustomDie{Name: name}
+	for i, raw := range strings.Split(faces, ",") {
+		label, value, hasValue := strings.Cut(raw, "=")
+		label = strings.TrimSpace(label)
+		if label == "" || len(label) > MaxFaceLabelLength {
+			return nil, fmt.Errorf("%w: face %d needs a label of at most %d characters", ErrInvalidExpression, i+1, MaxFaceLabelLength)
+		}
+		face := model.Face{Label: label, Value: i + 1}
+		if hasValue {
+			v, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || v > MaxNumber || v < -MaxNumber {
+				return nil, fmt.Errorf("%w: face %q has an invalid value", ErrInvalidExpression, label)
+			}
+			face.Value = v
+		}
+		die.Faces = append(die.Faces, face)
+	}
+	if len(die.Faces) < 2 || len(die.Faces) > MaxCustomFaces {
+		return nil, fmt.Errorf("%w: a custom die needs between 2 and %d faces", ErrInvalidExpression, MaxCustomFaces)
+	}
+	return &die, nil
+}
+
+// CustomDiceUsed returns the custom dice that groups were rolled with.
+func CustomDiceUsed(groups []model.DiceGroup, custom []model.CustomDie) []model.CustomDie {
+	var used []model.CustomDie
+	for _, c := range custom {
+		for _, g := range groups {
+			if g.Die == "d{"+c.Name+"}" {
+				used = append(used, c)
+				break
+			}
+		}
+	}
+	return used
+}
+
+// DiceTypes lists the picker entries for a room: the standard dice followed by its custom ones.
+func DiceTypes(custom []model.CustomDie) []string {
+	types := append([]string{}, StandardDice...)
+	for _, c := range custom {
+		types = append(types, "d{"+c.Name+"}")
+	}
+	return types
+}
@@ -0,0 +1,88 @@
+// Package dice parses and evaluates tabletop dice notation such as
+// "3d6+2", "2d20kh1", "4d6dl1" or "(1d8+1d6+3)*2".
+package dice
+
+import (
+	"dice_room/model"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	MaxExpressionLength = 200
+	MaxDice             = 1000
+	MaxSides            = 10000
+	MaxNumber           = 1000000
+	maxMagnitude        = 1 << 40
+)
+
+// ErrInvalidExpression is returned, wrapped with detail, for anything that is not valid notation.
+var ErrInvalidExpression = errors.New("invalid dice expression")
+
+// Result is the outcome of evaluating a dice expression.
+type Result struct {
+	Expression string
+	Total      int
+	Pool       *model.PoolOutcome
+	Groups     []model.DiceGroup
+}
+
+// DieType returns the die of the first dice group, such as "d6" or "dF", used to colour the log.
+// It is empty for expressions with no dice in them.
+func (r *Result) DieType() string {
+	if len(r.Groups) == 0 {
+		return ""
+	}
+	return r.Groups[0].Die
+}
+
+// Roll parses expr and evaluates it, drawing each die from roller. custom
+// holds the room's own dice, which expressions refer to as d{name}.
+func Roll(expr string, roller Roller, custom []model.CustomDie) (*Result, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if expr == "" {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidExpression)
+	}
+	if len(expr) > MaxExpressionLength {
+		return nil, fmt.Errorf("%w: longer than %d characters", ErrInvalidExpression, MaxExpressionLength)
+	}
+	root, err := parse(expr, custom)
+	if err != nil {
+		return nil, err
+	}
+	ev := evaluator{roller: roller}
+	total, err := root.eval(&ev)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Expression: expr,
+		Total:      total,
+		Pool:       poolOf(ev.groups),
+		Groups:     ev.groups,
+	}, nil
+}
+
+// poolOf combines the outcomes of every pool group, or returns nil if the
+// expression has no success-counting dice. Botches and critical glitches are
+// judged on the combined pool, as successes in one group save the roll.
+func poolOf(groups []model.DiceGroup) *model.PoolOutcome {
+	var pool *model.PoolOutcome
+	for _, g := range groups {
+		if g.Pool == nil {
+			continue
+		}
+		if pool == nil {
+			pool = &model.PoolOutcome{}
+		}
+		pool.Successes += g.Pool.Successes
+		pool.Failures += g.Pool.Failures
+		pool.Glitch = pool.Glitch || g.Pool.Glitch
+	}
+	if pool != nil {
+		pool.Botch = botched(pool)
+		pool.CriticalGlitch = pool.Glitch && pool.Successes == 0
+	}
+	return pool
+}
@@ -0,0 +1,205 @@
+package dice
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// scriptedRoller shows the given faces in order, so breakdowns can be checked exactly.
+type scriptedRoller struct {
+	t     *testing.T
+	faces []int
+}
+
+func script(t *testing.T, faces ...int) *scriptedRoller {
+	return &scriptedRoller{t: t, faces: faces}
+}
+
+func (s *scriptedRoller) Intn(n int) int {
+	s.t.Helper()
+	if len(s.faces) == 0 {
+		s.t.Fatal("scripted roller ran out of faces")
+	}
+	f := s.faces[0]
+	s.faces = s.faces[1:]
+	if f < 1 || f > n {
+		s.t.Fatalf("scripted face %d is not on a d%d", f, n)
+	}
+	return f - 1
+}
+
+// done fails the test if the roll did not use every scripted face.
+func (s *scriptedRoller) done() {
+	s.t.Helper()
+	if len(s.faces) > 0 {
+		s.t.Errorf("faces %v were never rolled", s.faces)
+	}
+}
+
+// dieText writes a group's dice the way a test expects them: the value,
+// then d for dropped and r for rerolled, e.g. "1d 4 6".
+func dieText(res *Result) string {
+	var groups []string
+	for _, g := range res.Groups {
+		var dice []string
+		for _, d := range g.Dice {
+			s := d.Text()
+			if d.Dropped {
+				s += "d"
+			}
+			if d.Rerolled {
+				s += "r"
+			}
+			if d.Exploded {
+				s += "!"
+			}
+			dice = append(dice, s)
+		}
+		groups = append(groups, strings.Join(dice, " "))
+	}
+	return strings.Join(groups, " | ")
+}
+
+func TestRoll(t *testing.T) {
+	for _, tc := range []struct {
+		expr  string
+		faces []int
+		total int
+		dice  string
+	}{
+		{"3d6+2", []int{1, 4, 6}, 13, "1 4 6"},
+		{"2d20kh1", []int{7, 15}, 15, "7d 15"},
+		{"2d20kl1", []int{7, 15}, 7, "7 15d"},
+		{"4d6dl1", []int{3, 1, 5, 1}, 9, "3 1d 5 1"},
+		{"4d6dh2", []int{3, 1, 5, 1}, 2, "3d 1 5d 1"},
+		{"4d6k3", []int{2, 6, 2, 4}, 12, "2d 6 2 4"},
+		{"1d8+1d6+3", []int{5, 2}, 10, "5 | 2"},
+		{"d20", []int{20}, 20, "20"},
+		{"(1d4+1)*2", []int{3}, 8, "3"},
+		{"2*(1d6-1)", []int{1}, 0, "1"},
+		{"-1d4", []int{2}, -2, "2"},
+		{"d%", []int{5, 3}, 42, "40+2"},
+		{"d%", []int{1, 1}, 100, "00+0"},
+		{"4df", []int{1, 2, 3, 3}, 1, "- 0 + +"},
+		{" 3 D6 + 2 ", []int{2, 2, 2}, 8, "2 2 2"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			roller := script(t, tc.faces...)
+			res, err := Roll(tc.expr, roller, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roller.done()
+			if res.Total != tc.total {
+				t.Errorf("total = %d, want %d", res.Total, tc.total)
+			}
+			if got := dieText(res); got != tc.dice {
+				t.Errorf("dice = %q, want %q", got, tc.dice)
+			}
+		})
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	for expr, want := range map[string]int{
+		"2+3*4":     14,
+		"(2+3)*4":   20,
+		"10-4-3":    3,
+		"12/4/3":    1,
+		"2*3+4*5":   26,
+		"-2*3":      -6,
+		"--2":       2,
+		"7/2":       3,
+		"-7/2":      -3,
+		"2*(3+(4))": 14,
+		"8-(2-1)":   7,
+	} {
+		res, err := Roll(expr, NewSeededRoller(1), nil)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if res.Total != want {
+			t.Errorf("%s = %d, want %d", expr, res.Total, want)
+		}
+		if len(res.Groups) != 0 || res.DieType() != "" {
+			t.Errorf("%s: dice groups %v in plain arithmetic", expr, res.Groups)
+		}
+	}
+}
+
+func TestGroupsRecordNotationAndTotals(t *testing.T) {
+	res, err := Roll("2d6kh1+1d8", script(t, 2, 5, 7), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Groups) != 2 {
+		t.Fatalf("groups = %+v, want 2", res.Groups)
+	}
+	first, second := res.Groups[0], res.Groups[1]
+	if first.Notation != "2d6kh1" || first.Die != "d6" || first.Sides != 6 || first.Total != 5 {
+		t.Errorf("first group = %+v", first)
+	}
+	if second.Notation != "1d8" || second.Die != "d8" || second.Total != 7 {
+		t.Errorf("second group = %+v", second)
+	}
+	if res.DieType() != "d6" || res.Expression != "2d6kh1+1d8" || res.Pool != nil {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestInvalidExpressions(t *testing.T) {
+	for expr, want := range map[string]string{
+		"":             "empty",
+		"   ":          "empty",
+		"3d":           "missing number of sides",
+		"d":            "missing number of sides",
+		"1d6+":         "unexpected end",
+		"(1d6":         "missing )",
+		"1d6)":         `unexpected ')'`,
+		"2x3":          `unexpected 'x'`,
+		"+3":           `unexpected '+'`,
+		"1d6kh1kl1":    "only one keep or drop",
+		"1d6r":         "reroll needs a value",
+		"1d6>":         "missing number after >",
+		"4d10f1":       "need a success target",
+		"1d6min4max2":  "min is greater than max",
+		"1d{location}": "no custom die",
+		"1/0":          "division by zero",
+		"0d6":          "dice count must be between 1",
+	} {
+		_, err := Roll(expr, NewSeededRoller(1), nil)
+		if !errors.Is(err, ErrInvalidExpression) {
+			t.Errorf("%q: err = %v, want ErrInvalidExpression", expr, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %q, want it to mention %q", expr, err, want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for expr, want := range map[string]string{
+		"1001d6":                        "dice count must be between 1 and 1000",
+		"1000d6":                        "",
+		"d10001":                        "sides must be between 1 and 10000",
+		"d10000":                        "",
+		"1000001":                       "number larger than 1000000",
+		"1000000":                       "",
+		"600d6+600d6":                   "more than 1000 dice in one roll",
+		"1000000*1000000":               "",
+		"1000000*1000000*2":             "result too large",
+		"-1000000*1000000*2":            "result too large",
+		strings.Repeat("1+", 100) + "1": "longer than 200 characters",
+	} {
+		_, err := Roll(expr, NewSeededRoller(1), nil)
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("%.20q: %v, want it allowed", expr, err)
+		case want != "" && (!errors.Is(err, ErrInvalidExpression) || !strings.Contains(err.Error(), want)):
+			t.Errorf("%.20q: err = %v, want %q", expr, err, want)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package dice
+
+import (
+	"dice_room/model"
+	"fmt"
+	"sort"
+)
+
+// evaluator carries the random source and collects the dice thrown while walking the tree.
+type evaluator struct {
+	roller Roller
+	thrown int
+	groups []model.DiceGroup
+}
+
+type node interface {
+	eval(ev *evaluator) (int, error)
+}
+
+type numberNode struct {
+	value int
+}
+
+func (n *numberNode) eval(ev *evaluator) (int, error) {
+	return n.value, nil
+}
+
+type negateNode struct {
+	operand node
+}
+
+func (n *negateNode) eval(ev *evaluator) (int, error) {
+	v, err := n.operand.eval(ev)
+	return -v, err
+}
+
+type binaryNode struct {
+	op          byte
+	left, right node
+}
+
+func (n *binaryNode) eval(ev *evaluator) (int, error) {
+	l, err := n.left.eval(ev)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(ev)
+	if err != nil {
+		return 0, err
+	}
+	var v int
+	switch n.op {
+	case '+':
+		v = l + r
+	case '-':
+		v = l - r
+	case '*':
+		v = l * r
+	case '/':
+		if r == 0 {
+			return 0, fmt.Errorf("%w: division by zero", ErrInvalidExpression)
+		}
+		v = l / r
+	}
+	if v > maxMagnitude || v < -maxMagnitude {
+		return 0, fmt.Errorf("%w: result too large", ErrInvalidExpression)
+	}
+	return v, nil
+}
+
+type selectKind int
+
+const (
+	keepHighest selectKind = iota
+	keepLowest
+	dropHighest
+	dropLowest
+)
+
+// selection is a keep/drop modifier such as kh1 or dl2.
+type selection struct {
+	kind selectKind
+	n    int
+}
+
+// compare is a compare point such as "1", "<3" or ">=5".
+type compare struct {
+	op string
+	n  int
+}
+
+func (c compare) matches(v int) bool {
+	switch c.op {
+	case "<":
+		return v < c.n
+	case "<=":
+		return v <= c.n
+	case ">":
+		return v > c.n
+	case ">=":
+		return v >= c.n
+	}
+	return v == c.n
+}
+
+// matchesAll reports whether every one of values matches.
+func (c compare) matchesAll(values []int) bool {
+	for _, v := range values {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+type diceNode struct {
+	notation    string
+	die         string
+	count       int
+	sides       int
+	faces       []model.Face
+	percentile  bool
+	selection   *selection
+	explode     *compare
+	compound    bool
+	reroll      *compare
+	rerollUntil bool
+	min, max    int
+	success     *compare
+	failure     *compare
+	double      *compare
+	glitch      bool
+}
+
+func (n *diceNode) eval(ev *evaluator) (int, error) {
+	var dice []model.Die
+	for i := 0; i < n.count; i++ {
+		thrown, err := n.throw(ev)
+		if err != nil {
+			return 0, err
+		}
+		dice = append(dice, thrown...)
+	}
+	if n.selection != nil {
+		n.selection.apply(dice)
+	}
+
+	group := model.DiceGroup{
+		Notation: n.notation,
+		Die:      n.die,
+		Sides:    n.sides,
+		Dice:     dice,
+	}
+	if n.success != nil {
+		group.Pool = n.countSuccesses(dice)
+		group.Total = max(group.Pool.Successes-group.Pool.Failures, 0)
+	} else {
+		for _, d := range dice {
+			if d.Counts() {
+				group.Total += d.Value
+			}
+		}
+	}
+	ev.groups = append(ev.groups, group)
+	return group.Total, nil
+}
+
+// countSuccesses marks each counted die as a success or failure and tallies the pool.
+// A botch is no successes and at least one failure; ones that cancel out
+// successes only make the roll fail. A glitch is more than half the dice
+// showing 1; with no successes it is critical.
+func (n *diceNode) countSuccesses(dice []model.Die) *model.PoolOutcome {
+	pool := &model.PoolOutcome{}
+	counted, ones := 0, 0
+	for i := range dice {
+		d := &dice[i]
+		if !d.Counts() {
+			continue
+		}
+		counted++
+		if d.Value == 1 {
+			ones++
+		}
+		if n.success.matches(d.Value) {
+			d.Successes = 1
+			if n.double != nil && n.double.matches(d.Value) {
+				d.Successes = 2
+			}
+			pool.Successes += d.Successes
+		} else if n.failure != nil && n.failure.matches(d.Value) {
+			d.Failure = true
+			pool.Failures++
+		}
+	}
+	pool.Botch = botched(pool)
+	if n.glitch && ones*2 > counted {
+		pool.Glitch = true
+		pool.CriticalGlitch = pool.Successes == 0
+	}
+	return pool
+}
+
+// botched reports a roll with no successes at all and at least one failure.
+func botched(pool *model.PoolOutcome) bool {
+	return pool.Successes == 0 && pool.Failures > 0
+}
+
+// throw rolls one die of the group and returns it along with every die its
+// modifiers produced, in order: rerolled faces, the kept face, then explosions.
+func (n *diceNode) throw(ev *evaluator) ([]model.Die, error) {
+	var out []model.Die
+	last, err := n.face(ev, &out)
+	if err != nil {
+		return nil, err
+	}
+	if n.explode == nil || !n.explode.matches(last.Value) {
+		return append(out, n.clamped(last)), nil
+	}
+
+	if n.compound {
+		rolls := []int{last.Value}
+		for n.explode.matches(last.Value) {
+			if last, err = n.toss(ev); err != nil {
+				return nil, err
+			}
+			rolls = append(rolls, last.Value)
+		}
+		sum := 0
+		for _, r := range rolls {
+			sum += r
+		}
+		d := n.clamped(model.Die{Value: sum})
+		d.Rolls = rolls
+		return append(out, d), nil
+	}
+
+	out = append(out, n.clamped(last))
+	for n.explode.matches(last.Value) {
+		if last, err = n.toss(ev); err != nil {
+			return nil, err
+		}
+		d := n.clamped(last)
+		d.Exploded = true
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// face tosses a single die, applying the reroll modifier. Replaced dice are
+// appended to out marked as rerolled.
+func (n *diceNode) face(ev *evaluator, out *[]model.Die) (model.Die, error) {
+	d, err := n.toss(ev)
+	if err != nil || n.reroll == nil {
+		return d, err
+	}
+	for n.reroll.matches(d.Value) {
+		d.Rerolled = true
+		*out = append(*out, d)
+		if d, err = n.toss(ev); err != nil {
+			return d, err
+		}
+		if !n.rerollUntil {
+			break
+		}
+	}
+	return d, nil
+}
+
+// toss throws one die of the node's kind with no modifiers applied.
+// Percentile dice are a tens and a units d10, where 00 and 0 make 100.
+func (n *diceNode) toss(ev *evaluator) (model.Die, error) {
+	if n.percentile {
+		tens, err := ev.roll(10)
+		if err != nil {
+			return model.Die{}, err
+		}
+		units, err := ev.roll(10)
+		if err != nil {
+			return model.Die{}, err
+		}
+		tens, units = (tens-1)*10, units-1
+		v := tens + units
+		if v == 0 {
+			v = 100
+		}
+		return model.Die{Value: v, Label: fmt.Sprintf("%02d+%d", tens, units)}, nil
+	}
+	r, err := ev.roll(n.sides)
+	if err != nil {
+		return model.Die{}, err
+	}
+	if n.faces != nil {
+		f := n.faces[r-1]
+		return model.Die{Value: f.Value, Label: f.Label}, nil
+	}
+	return model.Die{Value: r}, nil
+}
+
+// values lists every value a single die of this node can show.
+func (n *diceNode) values() []int {
+	var out []int
+	for _, f := range n.faces {
+		out = append(out, f.Value)
+	}
+	if n.faces == nil {
+		for v := 1; v <= n.sides; v++ {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// clamped applies the min and max modifiers to a die. The parser only allows
+// them on plain numbered dice, so there is never a label to keep in step.
+func (n *diceNode) clamped(d model.Die) model.Die {
+	v := d.Value
+	if n.min != 0 && v < n.min {
+		d.Value = n.min
+	}
+	if n.max != 0 && v > n.max {
+		d.Value = n.max
+	}
+	if d.Value != v {
+		d.Unclamped = v
+	}
+	return d
+}
+
+// roll throws a single die, enforcing the per-roll dice limit so that
+// explosions and rerolls cannot run away.
+func (ev *evaluator) roll(sides int) (int, error) {
+	ev.thrown++
+	if ev.thrown > MaxDice {
+		return 0, fmt.Errorf("%w: more than %d dice in one roll", ErrInvalidExpression, MaxDice)
+	}
+	return ev.roller.Intn(sides) + 1, nil
+}
+
+// apply marks the dice that the modifier discards, leaving them in throw order.
+// Rerolled dice no longer count and take no part in the selection.
+func (s *selection) apply(dice []model.Die) {
+	var order []int
+	for i, d := range dice {
+		if !d.Rerolled {
+			order = append(order, i)
+		}
+	}
+	// Lowest first; ties keep throw order so the earliest die is dropped first.
+	sort.SliceStable(order, func(i, j int) bool {
+		return dice[order[i]].Value < dice[order[j]].Value
+	})
+
+	n := min(s.n, len(order))
+	var drop []int
+	switch s.kind {
+	case keepHighest:
+		drop = order[:len(order)-n]
+	case keepLowest:
+		drop = order[n:]
+	case dropHighest:
+		drop = order[len(order)-n:]
+	case dropLowest:
+		drop = order[:n]
+	}
+	for _, i := range drop {
+		dice[i].Dropped = true
+	}
+}
@@ -0,0 +1,187 @@
+package dice
+
+import (
+	"dice_room/model"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// constRoller shows the same face on every die.
+type constRoller int
+
+func (c constRoller) Intn(n int) int {
+	return int(c) - 1
+}
+
+func TestModifiers(t *testing.T) {
+	for _, tc := range []struct {
+		expr  string
+		faces []int
+		total int
+		dice  string
+	}{
+		// Every exploded die is kept, after the die that set it off.
+		{"d6!", []int{6, 6, 2}, 14, "6 6! 2!"},
+		{"3d6!", []int{6, 1, 3, 4}, 14, "6 1! 3 4"},
+		{"d6!>=5", []int{5, 6, 1}, 12, "5 6! 1!"},
+		{"d6!1", []int{1, 1, 4}, 6, "1 1! 4!"},
+		{"2d6!kh1", []int{6, 3, 5}, 6, "6 3d! 5d"},
+		// Compounding adds the explosions into one die.
+		{"d6!!", []int{6, 6, 2}, 14, "14"},
+		{"2d6!!", []int{3, 6, 1}, 10, "3 7"},
+		// A reroll keeps the replaced faces, marked, in front of the kept one.
+		{"d10r1", []int{1, 1}, 1, "1r 1"},
+		{"d10r1", []int{7}, 7, "7"},
+		{"d10r<3", []int{2, 9}, 9, "2r 9"},
+		{"d10rr<3", []int{1, 2, 5}, 5, "1r 2r 5"},
+		{"2d10rr1kh1", []int{1, 4, 8}, 8, "1r 4d 8"},
+		{"d6r1!", []int{1, 6, 3}, 9, "1r 6 3!"},
+		// Clamps change the value and remember the face.
+		{"3d6min3", []int{1, 4, 6}, 13, "3 4 6"},
+		{"3d6max4", []int{1, 5, 6}, 9, "1 4 4"},
+		{"2d6min2max5", []int{1, 6}, 7, "2 5"},
+		{"d6!max4", []int{6, 2}, 6, "4 2!"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			roller := script(t, tc.faces...)
+			res, err := Roll(tc.expr, roller, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roller.done()
+			if res.Total != tc.total {
+				t.Errorf("total = %d, want %d", res.Total, tc.total)
+			}
+			if got := dieText(res); got != tc.dice {
+				t.Errorf("dice = %q, want %q", got, tc.dice)
+			}
+		})
+	}
+}
+
+func TestCompoundKeepsEveryRoll(t *testing.T) {
+	res, err := Roll("d6!!", script(t, 6, 6, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := res.Groups[0].Dice[0]
+	if d.Value != 14 || !slices.Equal(d.Rolls, []int{6, 6, 2}) {
+		t.Errorf("die = %+v, want 14 from rolls [6 6 2]", d)
+	}
+}
+
+func TestClampsKeepTheFaceRolled(t *testing.T) {
+	res, err := Roll("2d6min3max5", script(t, 1, 6), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dice := res.Groups[0].Dice
+	if dice[0].Value != 3 || dice[0].Unclamped != 1 || dice[1].Value != 5 || dice[1].Unclamped != 6 {
+		t.Errorf("dice = %+v, want 3 (rolled 1) and 5 (rolled 6)", dice)
+	}
+	res, err = Roll("d6min3", script(t, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := res.Groups[0].Dice[0]; d.Unclamped != 0 {
+		t.Errorf("unclamped die = %+v, want no Unclamped", d)
+	}
+}
+
+func TestModifiersThatNeverEnd(t *testing.T) {
+	for expr, want := range map[string]string{
+		"d6!>=1":    "explode forever",
+		"d6!<7":     "explode forever",
+		"d1!":       "explode forever",
+		"d1!!":      "explode forever",
+		"df!<2":     "explode forever",
+		"d6rr<7":    "reroll forever",
+		"d6rr>0":    "reroll forever",
+		"d6!!<=6":   "explode forever",
+		"d6!kh1!":   "only one explode",
+		"d6r1rr2":   "only one reroll",
+		"d%min2":    "only work on numbered dice",
+		"d6min0":    "clamp must be between 1 and 6",
+		"d6max7":    "clamp must be between 1 and 6",
+		"d6min2min": "only one min",
+	} {
+		_, err := Roll(expr, NewSeededRoller(1), nil)
+		if !errors.Is(err, ErrInvalidExpression) || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v, want %q", expr, err, want)
+		}
+	}
+	// Rerolling once can never run away, so any compare point is allowed.
+	if _, err := Roll("d6r<7", NewSeededRoller(1), nil); err != nil {
+		t.Errorf("d6r<7: %v", err)
+	}
+}
+
+func TestRunawayExplosionsHitTheDiceLimit(t *testing.T) {
+	for _, expr := range []string{"d6!", "d6!!", "10d6!"} {
+		_, err := Roll(expr, constRoller(6), nil)
+		if !errors.Is(err, ErrInvalidExpression) || !strings.Contains(err.Error(), "more than 1000 dice") {
+			t.Errorf("%s always showing 6: err = %v, want the dice limit", expr, err)
+		}
+	}
+	if _, err := Roll("d6rr1", constRoller(1), nil); err == nil || !strings.Contains(err.Error(), "more than 1000 dice") {
+		t.Errorf("d6rr1 always showing 1: err = %v, want the dice limit", err)
+	}
+}
+
+func TestPools(t *testing.T) {
+	for _, tc := range []struct {
+		expr  string
+		faces []int
+		total int
+		want  model.PoolOutcome
+	}{
+		{"8d10>=7", []int{7, 8, 10, 1, 1, 3, 5, 6}, 3, model.PoolOutcome{Successes: 3}},
+		{"8d10>=7", []int{2, 3, 4, 5, 6, 2, 3, 4}, 0, model.PoolOutcome{}},
+		// No successes and no ones is a failure, not a botch.
+		{"8d10>=7f1", []int{2, 3, 4, 5, 6, 2, 3, 4}, 0, model.PoolOutcome{}},
+		// Ones cancel successes.
+		{"8d10>=7f1", []int{7, 8, 10, 1, 3, 3, 5, 6}, 2, model.PoolOutcome{Successes: 3, Failures: 1}},
+		// Ones that cancel every success make a failure; only a roll with no successes botches.
+		{"8d10>=7f1", []int{7, 1, 1, 2, 3, 4, 5, 6}, 0, model.PoolOutcome{Successes: 1, Failures: 2}},
+		{"8d10>=7f1", []int{1, 2, 3, 4, 5, 6, 2, 3}, 0, model.PoolOutcome{Failures: 1, Botch: true}},
+		// Tens count twice.
+		{"8d10>=7db10", []int{10, 10, 7, 1, 2, 3, 4, 5}, 5, model.PoolOutcome{Successes: 5}},
+		{"8d10>=7f1db10", []int{10, 1, 1, 2, 3, 4, 5, 6}, 0, model.PoolOutcome{Successes: 2, Failures: 2}},
+		// A glitch is more than half the dice showing 1; with no successes it is critical.
+		{"8d10>=7g", []int{1, 1, 1, 1, 1, 7, 2, 3}, 1, model.PoolOutcome{Successes: 1, Glitch: true}},
+		{"8d10>=7g", []int{1, 1, 1, 1, 1, 2, 2, 3}, 0, model.PoolOutcome{Glitch: true, CriticalGlitch: true}},
+		{"8d10>=7g", []int{1, 1, 1, 1, 2, 2, 2, 3}, 0, model.PoolOutcome{}},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			roller := script(t, tc.faces...)
+			res, err := Roll(tc.expr, roller, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roller.done()
+			if res.Total != tc.total {
+				t.Errorf("total = %d, want %d", res.Total, tc.total)
+			}
+			if res.Pool == nil || *res.Pool != tc.want {
+				t.Errorf("pool = %+v, want %+v", res.Pool, tc.want)
+			}
+		})
+	}
+}
+
+func TestPoolsCombineAcrossGroups(t *testing.T) {
+	// The second group's success saves the first group's botch and critical glitch.
+	res, err := Roll("2d10>=7f1g+2d10>=7f1g", script(t, 1, 1, 8, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.PoolOutcome{Successes: 1, Failures: 2, Glitch: true}
+	if *res.Pool != want {
+		t.Errorf("pool = %+v, want %+v", *res.Pool, want)
+	}
+	if first := res.Groups[0].Pool; !first.Botch || !first.CriticalGlitch {
+		t.Errorf("first group = %+v, want a botch and a critical glitch", first)
+	}
+}
@@ -0,0 +1,136 @@
+package dice
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"dice_room/model"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Provably fair rolls use commit-reveal. Each room commits to a secret server
+// seed by publishing its SHA-256 hash. Every roll draws its dice from
+// HMAC-SHA256(serverSeed, clientSeed:nonce:round), so once the seed is
+// revealed anyone can recompute the roll, and the host could not have picked
+// the seed to suit a client seed it had not yet seen.
+
+// NewServerSeed makes a fresh 32 byte server seed. Seeds always come from
+// crypto/rand, whatever Roller the server uses: a seed that could be worked
+// out before it is revealed would let anyone predict every roll drawn from it.
+func NewServerSeed() model.ServerSeed {
+	seed := randomHex(32)
+	return model.ServerSeed{
+		Hash:    HashSeed(seed),
+		Seed:    seed,
+		Created: time.Now().UnixMilli(),
+	}
+}
+
+// NewClientSeed is used when the browser did not send a client seed of its own.
+func NewClientSeed() string {
+	return randomHex(16)
+}
+
+// HashSeed is the public commitment to a server seed.
+func HashSeed(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS entropy source is broken.
+		panic("dice: crypto/rand failed: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// FairRoller is the deterministic Roller for one provably fair roll.
+type FairRoller struct {
+	mu         sync.Mutex
+	serverSeed string
+	clientSeed string
+	nonce      int
+	round      int
+	block      []byte
+	digest     string
+}
+
+func NewFairRoller(serverSeed, clientSeed string, nonce int) *FairRoller {
+	f := &FairRoller{serverSeed: serverSeed, clientSeed: clientSeed, nonce: nonce}
+	f.next()
+	f.digest = hex.EncodeToString(f.block)
+	return f
+}
+
+// Digest is the hex of the first HMAC block, recorded as the roll's proof.
+func (f *FairRoller) Digest() string {
+	return f.digest
+}
+
+// next refills the block from the following HMAC round.
+func (f *FairRoller) next() {
+	mac := hmac.New(sha256.New, []byte(f.serverSeed))
+	mac.Write([]byte(f.clientSeed + ":" + strconv.Itoa(f.nonce) + ":" + strconv.Itoa(f.round)))
+	f.block = mac.Sum(nil)
+	f.round++
+}
+
+func (f *FairRoller) uint32() uint32 {
+	if len(f.block) < 4 {
+		f.next()
+	}
+	v := binary.BigEndian.Uint32(f.block)
+	f.block = f.block[4:]
+	return v
+}
+
+// Intn uses rejection sampling so every face is exactly equally likely.
+func (f *FairRoller) Intn(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	limit := (1 << 32) / uint64(n) * uint64(n)
+	for {
+		if v := uint64(f.uint32()); v < limit {
+			return int(v % uint64(n))
+		}
+	}
+}
+
+// Verify recomputes a provably fair entry from its revealed server seed and
+// reports whether the recorded result and every recorded die match. The
+// custom dice recorded in the proof are used if it has any; custom is the
+// room's dice, for rolls proven before proofs recorded them.
+func Verify(entry model.LogEntry, serverSeed string, custom []model.CustomDie) bool {
+	p := entry.Proof
+	if p == nil || HashSeed(serverSeed) != p.SeedHash {
+		return false
+	}
+	if p.Dice != nil {
+		custom = p.Dice
+	}
+	roller := NewFairRoller(serverSeed, p.ClientSeed, p.Nonce)
+	if roller.Digest() != p.Digest {
+		return false
+	}
+	res, err := Roll(entry.Expression, roller, custom)
+	if err != nil || res.Total != entry.Result || len(res.Groups) != len(entry.Groups) {
+		return false
+	}
+	for i, g := range res.Groups {
+		if len(g.Dice) != len(entry.Groups[i].Dice) {
+			return false
+		}
+		for j, d := range g.Dice {
+			if d.Value != entry.Groups[i].Dice[j].Value {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package dice
+
+import (
+	"dice_room/model"
+	"reflect"
+	"testing"
+)
+
+func TestServerSeedsAreFreshAndCommitted(t *testing.T) {
+	a, b := NewServerSeed(), NewServerSeed()
+	if len(a.Seed) != 64 || a.Seed == b.Seed {
+		t.Errorf("seeds %q and %q, want two different 32 byte hex seeds", a.Seed, b.Seed)
+	}
+	if a.Hash != HashSeed(a.Seed) || a.Revealed {
+		t.Errorf("seed = %+v, want an unrevealed seed committed to by its hash", a)
+	}
+	if c := NewClientSeed(); len(c) != 32 || c == NewClientSeed() {
+		t.Errorf("client seed %q, want fresh 16 byte hex seeds", c)
+	}
+}
+
+// fairEntry rolls expr provably fair the way the server records it.
+func fairEntry(t *testing.T, seed model.ServerSeed, clientSeed string, nonce int, expr string, custom []model.CustomDie) model.LogEntry {
+	t.Helper()
+	roller := NewFairRoller(seed.Seed, clientSeed, nonce)
+	res, err := Roll(expr, roller, custom)
+	if err != nil {
+		t.Fatalf("Roll(%q): %v", expr, err)
+	}
+	return model.LogEntry{
+		Expression: res.Expression,
+		Result:     res.Total,
+		Groups:     res.Groups,
+		Proof: &model.Proof{
+			SeedHash:   seed.Hash,
+			ClientSeed: clientSeed,
+			Nonce:      nonce,
+			Digest:     roller.Digest(),
+			Dice:       CustomDiceUsed(res.Groups, custom),
+		},
+	}
+}
+
+func TestFairRollsVerify(t *testing.T) {
+	seed := NewServerSeed()
+	loc, _ := ParseCustomDie("loc", "Head, Torso, Arm, Leg")
+	custom := []model.CustomDie{*loc}
+	for _, expr := range []string{"d20", "4d6dl1+2", "3d{loc}", "30d6!"} {
+		entry := fairEntry(t, seed, "client", 7, expr, custom)
+		if !Verify(entry, seed.Seed, custom) {
+			t.Errorf("%s: a fair roll does not verify", expr)
+		}
+		if again := fairEntry(t, seed, "client", 7, expr, custom); !reflect.DeepEqual(again, entry) {
+			t.Errorf("%s: the same seeds and nonce rolled %+v, then %+v", expr, entry.Groups, again.Groups)
+		}
+	}
+}
+
+func TestExplodingDiceDrawOverSeveralRounds(t *testing.T) {
+	seed := NewServerSeed()
+	// 30 dice need more draws than the 8 a single HMAC block holds.
+	roller := NewFairRoller(seed.Seed, "client", 1)
+	if _, err := Roll("30d6!", roller, nil); err != nil {
+		t.Fatal(err)
+	}
+	if roller.round < 4 {
+		t.Errorf("30d6! drew from %d rounds, want at least 4", roller.round)
+	}
+	entry := fairEntry(t, seed, "client", 1, "30d6!", nil)
+	if !Verify(entry, seed.Seed, nil) {
+		t.Error("a roll over several rounds does not verify")
+	}
+	last := &entry.Groups[0].Dice[len(entry.Groups[0].Dice)-1]
+	last.Value = last.Value%6 + 1
+	if Verify(entry, seed.Seed, nil) {
+		t.Error("a roll with its last die changed still verifies")
+	}
+}
+
+func TestTamperedRollsDoNotVerify(t *testing.T) {
+	seed := NewServerSeed()
+	loc, _ := ParseCustomDie("loc", "Head, Torso, Arm, Leg")
+	custom := []model.CustomDie{*loc}
+	tampers := map[string]func(e *model.LogEntry){
+		"nonce":       func(e *model.LogEntry) { e.Proof.Nonce++ },
+		"client seed": func(e *model.LogEntry) { e.Proof.ClientSeed += "x" },
+		"result":      func(e *model.LogEntry) { e.Result++ },
+		"die":         func(e *model.LogEntry) { e.Groups[0].Dice[0].Value = e.Groups[0].Dice[0].Value%4 + 1 },
+		"seed hash":   func(e *model.LogEntry) { e.Proof.SeedHash = HashSeed("other") },
+		"custom die": func(e *model.LogEntry) {
+			redefined, _ := ParseCustomDie("loc", "Head=5, Torso=6, Arm=7, Leg=8")
+			e.Proof.Dice = []model.CustomDie{*redefined}
+		},
+	}
+	for name, tamper := range tampers {
+		entry := fairEntry(t, seed, "client", 3, "5d{loc}", custom)
+		tamper(&entry)
+		if Verify(entry, seed.Seed, custom) {
+			t.Errorf("a roll with its %s changed still verifies", name)
+		}
+	}
+	if entry := fairEntry(t, seed, "client", 3, "5d{loc}", custom); Verify(entry, NewServerSeed().Seed, custom) {
+		t.Error("a roll verifies against another server seed")
+	}
+}
+
+func TestProofKeepsTheCustomDiceItUsed(t *testing.T) {
+	seed := NewServerSeed()
+	loc, _ := ParseCustomDie("loc", "Head, Torso, Arm, Leg")
+	hit, _ := ParseCustomDie("hit", "Miss=0, Hit=1")
+	entry := fairEntry(t, seed, "c", 0, "3d{loc}", []model.CustomDie{*loc, *hit})
+	if len(entry.Proof.Dice) != 1 || entry.Proof.Dice[0].Name != "loc" {
+		t.Fatalf("proof records dice %+v, want only loc", entry.Proof.Dice)
+	}
+
+	// The GM redefines the die after the roll.
+	redefined, _ := ParseCustomDie("loc", "Head=10, Torso=20, Arm=30, Leg=40")
+	if !Verify(entry, seed.Seed, []model.CustomDie{*redefined}) {
+		t.Error("roll no longer verifies after its custom die was redefined")
+	}
+}
@@ -0,0 +1,364 @@
+package dice
+
+import (
+	"dice_room/model"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Grammar, whitespace insensitive:
+//
+//	expr    := term (("+" | "-") term)*
+//	term    := unary (("*" | "/") unary)*
+//	unary   := "-" unary | primary
+//	primary := number | dice | "(" expr ")"
+//	dice    := [number] "d" (number | "%" | "f" | "{" name "}") modifier*
+//	modifier := ("kh" | "kl" | "dh" | "dl" | "k") [number]
+//	          | "!!" [compare] | "!" [compare]
+//	          | "rr" compare | "r" compare
+//	          | ("min" | "max") number
+//	          | ("<" | "<=" | ">" | ">=" | "=") number   success target, makes a pool
+//	          | ("f" | "db") compare | "g"               pool only
+//	compare := ["<" | "<=" | ">" | ">=" | "="] number
+//
+// A compare point straight after "!" belongs to the explosion, so a pool of
+// exploding dice needs the explosion spelled out: 8d10!10>=7.
+type parser struct {
+	src    string
+	pos    int
+	custom []model.CustomDie
+}
+
+func parse(src string, custom []model.CustomDie) (node, error) {
+	p := parser{src: strings.Join(strings.Fields(src), ""), custom: custom}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return n, nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at position %d", ErrInvalidExpression, fmt.Sprintf(format, args...), p.pos+1)
+}
+
+func (p *parser) peek() byte {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// accept consumes s if the input continues with it.
+func (p *parser) accept(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// number reads an unsigned integer literal. ok is false if there is none.
+func (p *parser) number() (value int, ok bool, err error) {
+	start := p.pos
+	for isDigit(p.peek()) {
+		value = value*10 + int(p.peek()-'0')
+		if value > MaxNumber {
+			return 0, false, p.errorf("number larger than %d", MaxNumber)
+		}
+		p.pos++
+	}
+	return value, p.pos > start, nil
+}
+
+func (p *parser) expr() (node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) term() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateNode{operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	if p.accept("(") {
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("missing )")
+		}
+		return inner, nil
+	}
+
+	start := p.pos
+	count, hasCount, err := p.number()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 'd' {
+		if !hasCount {
+			if p.pos >= len(p.src) {
+				return nil, p.errorf("unexpected end of expression")
+			}
+			return nil, p.errorf("unexpected %q", p.peek())
+		}
+		return &numberNode{value: count}, nil
+	}
+	p.pos++
+	if !hasCount {
+		count = 1
+	}
+	return p.dice(start, count)
+}
+
+// dice parses the sides and modifiers of a dice term whose count and "d" have been read.
+func (p *parser) dice(start int, count int) (node, error) {
+	if count < 1 || count > MaxDice {
+		return nil, p.errorf("dice count must be between 1 and %d", MaxDice)
+	}
+	d, err := p.dieKind()
+	if err != nil {
+		return nil, err
+	}
+	d.count = count
+
+	for {
+		var err error
+		switch {
+		case p.accept("kh"):
+			err = p.selection(d, keepHighest)
+		case p.accept("kl"):
+			err = p.selection(d, keepLowest)
+		case p.accept("dh"):
+			err = p.selection(d, dropHighest)
+		case p.accept("dl"):
+			err = p.selection(d, dropLowest)
+		case p.accept("k"):
+			err = p.selection(d, keepHighest)
+		case p.accept("!!"):
+			err = p.explode(d, true)
+		case p.accept("!"):
+			err = p.explode(d, false)
+		case p.accept("rr"):
+			err = p.reroll(d, true)
+		case p.accept("r"):
+			err = p.reroll(d, false)
+		case p.accept("min"):
+			err = p.clamp(d, &d.min)
+		case p.accept("max"):
+			err = p.clamp(d, &d.max)
+		case p.accept("db"):
+			err = p.poolCompare(&d.double)
+		case p.accept("f"):
+			err = p.poolCompare(&d.failure)
+		case p.accept("g"):
+			d.glitch = true
+		case strings.IndexByte("<>=", p.peek()) >= 0:
+			err = p.poolCompare(&d.success)
+		default:
+			if d.min != 0 && d.max != 0 && d.min > d.max {
+				return nil, p.errorf("min is greater than max")
+			}
+			if d.success == nil && (d.failure != nil || d.double != nil || d.glitch) {
+				return nil, p.errorf("f, db and g need a success target such as >=7")
+			}
+			d.notation = p.src[start:p.pos]
+			return d, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dieKind parses what follows the "d": a number of sides, % for percentile,
+// f for Fudge or a room's custom die in braces.
+func (p *parser) dieKind() (*diceNode, error) {
+	switch {
+	case p.accept("%"):
+		return &diceNode{die: "d%", sides: 100, percentile: true}, nil
+	case p.accept("f"):
+		return &diceNode{die: "dF", sides: len(fudgeFaces), faces: fudgeFaces}, nil
+	case p.accept("{"):
+		end := strings.IndexByte(p.src[p.pos:], '}')
+		if end < 0 {
+			return nil, p.errorf("missing }")
+		}
+		name := p.src[p.pos : p.pos+end]
+		for _, c := range p.custom {
+			if strings.EqualFold(c.Name, name) {
+				p.pos += end + 1
+				return &diceNode{die: "d{" + c.Name + "}", sides: len(c.Faces), faces: c.Faces}, nil
+			}
+		}
+		return nil, p.errorf("no custom die called %q in this room", name)
+	}
+	sides, ok, err := p.number()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, p.errorf("missing number of sides")
+	}
+	if sides < 1 || sides > MaxSides {
+		return nil, p.errorf("sides must be between 1 and %d", MaxSides)
+	}
+	return &diceNode{die: "d" + strconv.Itoa(sides), sides: sides}, nil
+}
+
+func (p *parser) selection(d *diceNode, kind selectKind) error {
+	if d.selection != nil {
+		return p.errorf("only one keep or drop modifier is allowed")
+	}
+	n, ok, err := p.number()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		n = 1
+	}
+	d.selection = &selection{kind: kind, n: n}
+	return nil
+}
+
+func (p *parser) explode(d *diceNode, compound bool) error {
+	if d.explode != nil {
+		return p.errorf("only one explode modifier is allowed")
+	}
+	c, ok, err := p.compare()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c = compare{op: "=", n: slices.Max(d.values())}
+	}
+	if c.matchesAll(d.values()) {
+		return p.errorf("dice would explode forever")
+	}
+	d.explode = &c
+	d.compound = compound
+	return nil
+}
+
+func (p *parser) reroll(d *diceNode, untilDone bool) error {
+	if d.reroll != nil {
+		return p.errorf("only one reroll modifier is allowed")
+	}
+	c, ok, err := p.compare()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.errorf("reroll needs a value, e.g. r1 or rr<3")
+	}
+	if untilDone && c.matchesAll(d.values()) {
+		return p.errorf("dice would reroll forever")
+	}
+	d.reroll = &c
+	d.rerollUntil = untilDone
+	return nil
+}
+
+func (p *parser) clamp(d *diceNode, bound *int) error {
+	if d.faces != nil || d.percentile {
+		return p.errorf("min and max only work on numbered dice")
+	}
+	if *bound != 0 {
+		return p.errorf("only one min and one max modifier are allowed")
+	}
+	n, ok, err := p.number()
+	if err != nil {
+		return err
+	}
+	if !ok || n < 1 || n > d.sides {
+		return p.errorf("clamp must be between 1 and %d", d.sides)
+	}
+	*bound = n
+	return nil
+}
+
+// poolCompare reads the compare point of a pool modifier into target.
+func (p *parser) poolCompare(target **compare) error {
+	if *target != nil {
+		return p.errorf("pool modifiers may only be given once")
+	}
+	c, ok, err := p.compare()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.errorf("missing number")
+	}
+	*target = &c
+	return nil
+}
+
+// compare reads an optional comparison operator and the number after it.
+// A bare number means equality. ok is false if there is no number.
+func (p *parser) compare() (c compare, ok bool, err error) {
+	c.op = "="
+	hasOp := false
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if p.accept(op) {
+			c.op = op
+			hasOp = true
+			break
+		}
+	}
+	c.n, ok, err = p.number()
+	if err == nil && !ok && hasOp {
+		err = p.errorf("missing number after %s", c.op)
+	}
+	return c, ok, err
+}
@@ -0,0 +1,43 @@
+package dice
+
+import (
+	crand "crypto/rand"
+	"math/big"
+	"math/rand/v2"
+	"sync"
+)
+
+// Roller is the source of randomness behind every die. Intn returns a
+// uniformly distributed value in [0, n) and must be safe for concurrent use.
+type Roller interface {
+	Intn(n int) int
+}
+
+// CryptoRoller draws from crypto/rand. It is the production default.
+type CryptoRoller struct{}
+
+func (CryptoRoller) Intn(n int) int {
+	v, err := crand.Int(crand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand only fails if the OS entropy source is broken.
+		panic("dice: crypto/rand failed: " + err.Error())
+	}
+	return int(v.Int64())
+}
+
+// SeededRoller is a deterministic Roller: the same seed always produces the
+// same sequence of dice, which makes rolls reproducible in tests and replays.
+type SeededRoller struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func NewSeededRoller(seed uint64) *SeededRoller {
+	return &SeededRoller{rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (s *SeededRoller) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.IntN(n)
+}
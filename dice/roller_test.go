@@ -0,0 +1,39 @@
+package dice
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeededRollerRepeatsItsSequence(t *testing.T) {
+	a, b, other := NewSeededRoller(42), NewSeededRoller(42), NewSeededRoller(43)
+	same := true
+	for i := 0; i < 100; i++ {
+		x, y, z := a.Intn(20), b.Intn(20), other.Intn(20)
+		if x != y {
+			t.Fatalf("draw %d: %d and %d from the same seed", i, x, y)
+		}
+		if x < 0 || x >= 20 {
+			t.Fatalf("draw %d: %d is outside [0, 20)", i, x)
+		}
+		same = same && x == z
+	}
+	if same {
+		t.Error("a different seed gave the same 100 draws")
+	}
+}
+
+func TestSeededRollsAreReproducible(t *testing.T) {
+	const expr = "4d6dl1+2d10!+d%+4df"
+	first, err := Roll(expr, NewSeededRoller(7), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Roll(expr, NewSeededRoller(7), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("same seed, different rolls:\n%+v\n%+v", first, again)
+	}
+}
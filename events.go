@@ -1,48 +1,409 @@
 package main
 
-import "sync"
+import (
+	"context"
+	"dice_room/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
 
-// Broadcaster manages SSE subscriber channels per room.
-type Broadcaster struct {
-	mu          sync.Mutex
-	subscribers map[string][]chan string
+const (
+	defaultSubscriberBuffer = 64
+	defaultHeartbeat        = 25 * time.Second
+	defaultRetry            = 3 * time.Second
+	defaultMaxLifetime      = 30 * time.Minute
+	defaultMaxPerRoom       = 200
+)
+
+// ErrRoomFull is returned by Subscribe when a room has as many streams open
+// as it may.
+var ErrRoomFull = errors.New("too many live streams in this room")
+
+// StreamConfig tunes live room streams. Zero fields take the defaults.
+type StreamConfig struct {
+	// Buffer is how many events a subscriber may fall behind by before it is cut off.
+	Buffer int
+	// Heartbeat is how often a stream writes a comment line, so proxies do not close it as idle.
+	Heartbeat time.Duration
+	// Retry is the reconnect delay suggested to EventSource.
+	Retry time.Duration
+	// MaxLifetime ends a stream after this long. The browser reconnects and
+	// replays from Last-Event-ID, so long-lived connections are recycled cleanly.
+	MaxLifetime time.Duration
+	// MaxPerRoom caps the streams open in one room at once.
+	MaxPerRoom int
 }
 
-func NewBroadcaster() *Broadcaster {
-	return &Broadcaster{subscribers: make(map[string][]chan string)}
+func (c StreamConfig) withDefaults() StreamConfig {
+	if c.Buffer < 1 {
+		c.Buffer = defaultSubscriberBuffer
+	}
+	if c.Heartbeat <= 0 {
+		c.Heartbeat = defaultHeartbeat
+	}
+	if c.Retry <= 0 {
+		c.Retry = defaultRetry
+	}
+	if c.MaxLifetime <= 0 {
+		c.MaxLifetime = defaultMaxLifetime
+	}
+	if c.MaxPerRoom < 1 {
+		c.MaxPerRoom = defaultMaxPerRoom
+	}
+	return c
 }
 
-// Subscribe registers a new channel for the given room and returns it.
-func (b *Broadcaster) Subscribe(roomID string) chan string {
-	ch := make(chan string, 16)
-	b.mu.Lock()
-	b.subscribers[roomID] = append(b.subscribers[roomID], ch)
-	b.mu.Unlock()
-	return ch
+// Event is one encoded model.RoomEvent on a room's stream. ID is the Seq of
+// the roll it carries, which browsers send back as Last-Event-ID when they
+// reconnect, or 0.
+type Event struct {
+	ID   int64
+	Data string
+	// Redacted, if set, is sent instead of Data to viewers who may not see it.
+	Redacted string
+	// audience is who may have Data.
+	audience audience
+	// final ends the streams Data is sent on, once it is written.
+	final bool
+	// roster, on presence events, is the sending instance's own players.
+	roster *rosterUpdate
+}
+
+// audience is who may see an event's Data. It is plain data rather than a
+// func so that events can be shared with other instances. The zero audience
+// is everyone.
+type audience struct {
+	// Visibility and PlayerID limit Data as they limit a roll's.
+	Visibility string `json:"visibility,omitempty"`
+	PlayerID   string `json:"playerId,omitempty"`
+	// Only limits Data to PlayerID's own streams.
+	Only bool `json:"only,omitempty"`
 }
 
-// Unsubscribe removes the channel from the room and closes it.
-func (b *Broadcaster) Unsubscribe(roomID string, ch chan string) {
+func (a audience) sees(v model.Viewer) bool {
+	if a.Only {
+		return a.PlayerID != "" && v.PlayerID == a.PlayerID
+	}
+	return v.Sees(model.LogEntry{Visibility: a.Visibility, PlayerID: a.PlayerID})
+}
+
+// For is ev as viewer may see it, and false if it must not be sent to them.
+func (ev Event) For(viewer model.Viewer) (Event, bool) {
+	if ev.audience.sees(viewer) {
+		return Event{ID: ev.ID, Data: ev.Data, final: ev.final}, true
+	}
+	if ev.Redacted != "" {
+		return Event{ID: ev.ID, Data: ev.Redacted}, true
+	}
+	return Event{}, false
+}
+
+// newEvent encodes a room event for the stream.
+func newEvent(ev model.RoomEvent) (Event, error) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{ID: ev.ID, Data: string(b)}, nil
+}
+
+// newRollEvent encodes a recorded roll for the stream, limited to the viewers
+// who may see it and with the redacted copy for the rest, if there is one.
+func newRollEvent(roomID string, entry *model.LogEntry) (Event, error) {
+	ev, err := newEvent(model.NewRollEvent(roomID, entry))
+	if err != nil || entry.Visibility == model.VisibilityPublic {
+		return ev, err
+	}
+	ev.audience = audience{Visibility: entry.Visibility, PlayerID: entry.PlayerID}
+	if redacted, ok := entry.Redacted(); ok {
+		hidden, err := newEvent(model.NewRollEvent(roomID, &redacted))
+		if err != nil {
+			return Event{}, err
+		}
+		ev.Redacted = hidden.Data
+	}
+	return ev, nil
+}
+
+// newKickEvent tells the player the GM removed that they are out, and ends
+// their streams. Nobody else is sent it.
+func newKickEvent(roomID, playerID string, banned bool) (Event, error) {
+	ev, err := newEvent(model.RoomEvent{
+		Type:    model.EventKick,
+		RoomID:  roomID,
+		Payload: model.KickPayload{Banned: banned},
+	})
+	if err != nil {
+		return Event{}, err
+	}
+	ev.audience = audience{PlayerID: playerID, Only: true}
+	ev.final = true
+	return ev, nil
+}
+
+// StreamWriter frames a room stream for one transport.
+type StreamWriter interface {
+	// Start is called once before any event, with the reconnect delay to suggest.
+	Start(retry time.Duration) error
+	Event(ev Event) error
+	Heartbeat() error
+}
+
+// sseWriter frames a stream as text/event-stream.
+type sseWriter struct {
+	w     io.Writer
+	flush func()
+}
+
+func (s sseWriter) Start(retry time.Duration) error {
+	_, err := fmt.Fprintf(s.w, "retry: %d\n\n", retry.Milliseconds())
+	s.flush()
+	return err
+}
+
+func (s sseWriter) Event(ev Event) error {
+	if ev.ID != 0 {
+		fmt.Fprintf(s.w, "id: %d\n", ev.ID)
+	}
+	_, err := fmt.Fprintf(s.w, "data: %s\n\n", ev.Data)
+	s.flush()
+	return err
+}
+
+func (s sseWriter) Heartbeat() error {
+	_, err := fmt.Fprint(s.w, ": ping\n\n")
+	s.flush()
+	return err
+}
+
+// Subscriber is one stream's view of a room. Events are buffered up to the
+// broadcaster's limit; a subscriber that falls further behind is removed and
+// Resync is closed instead of events being silently lost.
+type Subscriber struct {
+	roomID string
+	viewer model.Viewer
+	events chan Event
+	resync chan struct{}
+}
+
+// Viewer is who the stream is for. Their Name is "" if they have not joined.
+func (s *Subscriber) Viewer() model.Viewer {
+	return s.viewer
+}
+
+// Events delivers the room's events. It is closed by Unsubscribe and Close.
+func (s *Subscriber) Events() <-chan Event {
+	return s.events
+}
+
+// Resync is closed if the subscriber was cut off for being too slow.
+func (s *Subscriber) Resync() <-chan struct{} {
+	return s.resync
+}
+
+// BroadcastStats counts the events slow subscribers never received and the
+// subscribers cut off for being slow.
+type BroadcastStats struct {
+	Dropped      uint64
+	Disconnected uint64
+}
+
+// Broadcaster fans room events out to the live streams subscribed to them.
+// Each stream is sent only what its viewer may see.
+type Broadcaster interface {
+	// Subscribe registers a stream opened by viewer, or returns ErrRoomFull.
+	Subscribe(roomID string, viewer model.Viewer) (*Subscriber, error)
+	Unsubscribe(roomID string, sub *Subscriber)
+	Send(roomID string, ev Event)
+	// Stream serves one subscriber's stream until it ends.
+	Stream(ctx context.Context, w StreamWriter, sub *Subscriber, replay []Event, seen int64)
+	// Close ends every subscription, for shutdown.
+	Close()
+}
+
+// LocalBroadcaster is the in-process Broadcaster. It only reaches streams
+// served by this instance.
+type LocalBroadcaster struct {
+	mu          sync.Mutex
+	config      StreamConfig
+	subscribers map[string][]*Subscriber
+	stats       BroadcastStats
+	closed      bool
+}
+
+func NewLocalBroadcaster(config StreamConfig) *LocalBroadcaster {
+	return &LocalBroadcaster{config: config.withDefaults(), subscribers: make(map[string][]*Subscriber)}
+}
+
+// Subscribe registers a new subscriber for the given room and returns it,
+// unless the room already has MaxPerRoom. After Close the subscriber's
+// events are already closed.
+func (b *LocalBroadcaster) Subscribe(roomID string, viewer model.Viewer) (*Subscriber, error) {
+	sub := &Subscriber{
+		roomID: roomID,
+		viewer: viewer,
+		events: make(chan Event, b.config.Buffer),
+		resync: make(chan struct{}),
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.events)
+		return sub, nil
+	}
+	if len(b.subscribers[roomID]) >= b.config.MaxPerRoom {
+		return nil, ErrRoomFull
+	}
+	b.subscribers[roomID] = append(b.subscribers[roomID], sub)
+	return sub, nil
+}
+
+// remove takes sub out of the room and reports whether it was there.
+// The caller holds mu.
+func (b *LocalBroadcaster) remove(roomID string, sub *Subscriber) bool {
 	subs := b.subscribers[roomID]
 	for i := range subs {
-		if subs[i] == ch {
+		if subs[i] == sub {
 			b.subscribers[roomID] = append(subs[:i], subs[i+1:]...)
-			break
+			if len(b.subscribers[roomID]) == 0 {
+				delete(b.subscribers, roomID)
+			}
+			return true
 		}
 	}
-	close(ch)
+	return false
+}
+
+// Unsubscribe removes the subscriber from the room and closes its events.
+// A subscriber that was already cut off is left alone.
+func (b *LocalBroadcaster) Unsubscribe(roomID string, sub *Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remove(roomID, sub) {
+		close(sub.events)
+	}
 }
 
-// Send delivers a message to all subscribers of a room, skipping any that are full.
-func (b *Broadcaster) Send(roomID string, msg string) {
+// Send delivers an event to all subscribers of a room. A subscriber whose
+// buffer is full is cut off and told to resync.
+func (b *LocalBroadcaster) Send(roomID string, ev Event) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	for _, ch := range b.subscribers[roomID] {
+	// Iterate over a copy, as cutting a subscriber off edits the slice.
+	for _, sub := range append([]*Subscriber(nil), b.subscribers[roomID]...) {
 		select {
-		case ch <- msg:
+		case sub.events <- ev:
 		default:
+			b.remove(roomID, sub)
+			close(sub.resync)
+			// The stream ends at the resync, so anything still buffered counts as lost.
+			b.stats.Dropped += uint64(1 + len(sub.events))
+			b.stats.Disconnected++
+			log.Printf("broadcast: cut off slow subscriber in room %s (%d dropped, %d disconnected in total)",
+				roomID, b.stats.Dropped, b.stats.Disconnected)
+		}
+	}
+}
+
+// Stats returns the slow subscriber counters.
+func (b *LocalBroadcaster) Stats() BroadcastStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+func (b *LocalBroadcaster) hasSubscribers(roomID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers[roomID]) > 0
+}
+
+// rooms lists the rooms that have subscribers.
+func (b *LocalBroadcaster) rooms() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0, len(b.subscribers))
+	for id := range b.subscribers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Close ends every subscription so that open streams return and the HTTP
+// server can finish shutting down.
+func (b *LocalBroadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, subs := range b.subscribers {
+		for _, sub := range subs {
+			close(sub.events)
+		}
+	}
+	b.subscribers = make(map[string][]*Subscriber)
+}
+
+// Stream writes a room stream to w: the replayed events, then sub's live
+// events with heartbeats while the room is quiet, each as sub's viewer may
+// see it and none they may not. Live events at or below seen, or already
+// replayed, are skipped. It returns when ctx ends, sub is closed or cut off,
+// a write fails, a final event has been sent, or the stream reaches its
+// maximum lifetime.
+func (b *LocalBroadcaster) Stream(ctx context.Context, w StreamWriter, sub *Subscriber, replay []Event, seen int64) {
+	if err := w.Start(b.config.Retry); err != nil {
+		return
+	}
+	for _, ev := range replay {
+		seen = max(seen, ev.ID)
+		out, ok := ev.For(sub.viewer)
+		if !ok {
+			continue
+		}
+		if err := w.Event(out); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(b.config.Heartbeat)
+	defer heartbeat.Stop()
+	lifetime := time.NewTimer(b.config.MaxLifetime)
+	defer lifetime.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lifetime.C:
+			return
+		case <-heartbeat.C:
+			if err := w.Heartbeat(); err != nil {
+				return
+			}
+		case <-sub.Resync():
+			// Tell the client it was cut off so it reloads rather than trust a log with gaps.
+			if ev, err := newEvent(model.RoomEvent{Type: model.EventResync, RoomID: sub.roomID}); err == nil {
+				w.Event(ev)
+			}
+			return
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			if ev.ID != 0 && ev.ID <= seen {
+				continue
+			}
+			out, ok := ev.For(sub.viewer)
+			if !ok {
+				continue
+			}
+			if err := w.Event(out); err != nil || out.final {
+				return
+			}
 		}
 	}
 }
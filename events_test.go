@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"dice_room/model"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamBuffer is a goroutine-safe writer for capturing a stream.
+type streamBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *streamBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *streamBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// runStream starts Stream in the background and returns its output and a
+// channel that is closed when it returns.
+func runStream(ctx context.Context, b *LocalBroadcaster, sub *Subscriber, replay []Event, seen int64) (*streamBuffer, chan struct{}) {
+	out := &streamBuffer{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Stream(ctx, sseWriter{w: out, flush: func() {}}, sub, replay, seen)
+	}()
+	return out, done
+}
+
+func waitFor(t *testing.T, done chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// subscribe is Subscribe for a room that is not expected to be full.
+func subscribe(t *testing.T, b Broadcaster, roomID string, viewer model.Viewer) *Subscriber {
+	t.Helper()
+	sub, err := b.Subscribe(roomID, viewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestSendOnlyReachesRoomSubscribers(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{})
+	here, elsewhere := subscribe(t, b, "a", model.Viewer{}), subscribe(t, b, "b", model.Viewer{})
+	b.Send("a", Event{ID: 1, Data: "x"})
+
+	if ev := <-here.Events(); ev.ID != 1 || ev.Data != "x" {
+		t.Errorf("got %+v, want event 1", ev)
+	}
+	select {
+	case ev := <-elsewhere.Events():
+		t.Errorf("other room received %+v", ev)
+	default:
+	}
+}
+
+func TestSlowSubscriberIsCutOffWithResync(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{Buffer: 2})
+	fast, slow := subscribe(t, b, "r", model.Viewer{}), subscribe(t, b, "r", model.Viewer{})
+	for i := int64(1); i <= 3; i++ {
+		b.Send("r", Event{ID: i})
+		<-fast.Events()
+	}
+
+	select {
+	case <-slow.Resync():
+	default:
+		t.Fatal("slow subscriber was not told to resync")
+	}
+	select {
+	case <-fast.Resync():
+		t.Fatal("fast subscriber was told to resync")
+	default:
+	}
+	if got, want := b.Stats(), (BroadcastStats{Dropped: 3, Disconnected: 1}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	// The cut off subscriber no longer receives events, and unsubscribing it is harmless.
+	b.Send("r", Event{ID: 4})
+	if len(slow.Events()) != 2 {
+		t.Errorf("slow subscriber has %d buffered events, want 2", len(slow.Events()))
+	}
+	b.Unsubscribe("r", slow)
+	b.Unsubscribe("r", fast)
+}
+
+func TestStreamWritesRetryReplayAndLiveEvents(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{Retry: 1500 * time.Millisecond})
+	sub := subscribe(t, b, "r", model.Viewer{})
+	ctx, cancel := context.WithCancel(context.Background())
+	replay := []Event{{ID: 3, Data: "three"}, {ID: 4, Data: "four"}}
+	out, done := runStream(ctx, b, sub, replay, 2)
+
+	// 4 was replayed and 2 was already seen; only 5 is new.
+	b.Send("r", Event{ID: 2, Data: "two"})
+	b.Send("r", Event{ID: 4, Data: "four"})
+	b.Send("r", Event{ID: 5, Data: "five"})
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(out.String(), "five") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	waitFor(t, done, "stream to end after cancel")
+
+	want := "retry: 1500\n\n" +
+		"id: 3\ndata: three\n\n" +
+		"id: 4\ndata: four\n\n" +
+		"id: 5\ndata: five\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("stream =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestStreamSendsHeartbeats(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{Heartbeat: 5 * time.Millisecond})
+	sub := subscribe(t, b, "r", model.Viewer{})
+	ctx, cancel := context.WithCancel(context.Background())
+	out, done := runStream(ctx, b, sub, nil, 0)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(out.String(), ": ping\n\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	waitFor(t, done, "stream to end after cancel")
+	if n := strings.Count(out.String(), ": ping\n\n"); n < 2 {
+		t.Errorf("got %d heartbeats, want at least 2", n)
+	}
+}
+
+func TestStreamEndsAtMaxLifetime(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{MaxLifetime: 20 * time.Millisecond})
+	sub := subscribe(t, b, "r", model.Viewer{})
+	_, done := runStream(context.Background(), b, sub, nil, 0)
+	waitFor(t, done, "stream to reach its maximum lifetime")
+	b.Unsubscribe("r", sub)
+}
+
+func TestStreamEndsWithResyncWhenCutOff(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{Buffer: 1})
+	sub := subscribe(t, b, "r", model.Viewer{})
+	// Fill the buffer before the stream starts reading, then overflow it.
+	b.Send("r", Event{ID: 1})
+	b.Send("r", Event{ID: 2})
+	out, done := runStream(context.Background(), b, sub, nil, 0)
+	waitFor(t, done, "stream to end on resync")
+	if !strings.HasSuffix(out.String(), "data: {\"type\":\"resync\",\"roomId\":\"r\"}\n\n") {
+		t.Errorf("stream = %q, want it to end with a resync event", out.String())
+	}
+}
+
+func TestCloseEndsStreams(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{})
+	first, second := subscribe(t, b, "a", model.Viewer{}), subscribe(t, b, "b", model.Viewer{})
+	_, firstDone := runStream(context.Background(), b, first, nil, 0)
+	_, secondDone := runStream(context.Background(), b, second, nil, 0)
+
+	b.Close()
+	waitFor(t, firstDone, "first stream to end on close")
+	waitFor(t, secondDone, "second stream to end on close")
+
+	// Unsubscribing after Close must not close the channels a second time.
+	b.Unsubscribe("a", first)
+	b.Unsubscribe("b", second)
+
+	late := subscribe(t, b, "a", model.Viewer{})
+	if _, ok := <-late.Events(); ok {
+		t.Error("subscriber after Close received an event")
+	}
+}
+
+func TestSubscribeCapsStreamsPerRoom(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{MaxPerRoom: 2})
+	first := subscribe(t, b, "r", model.Viewer{})
+	subscribe(t, b, "r", model.Viewer{})
+	if _, err := b.Subscribe("r", model.Viewer{}); !errors.Is(err, ErrRoomFull) {
+		t.Fatalf("third stream: err = %v, want ErrRoomFull", err)
+	}
+	// Other rooms have their own cap, and leaving makes space.
+	subscribe(t, b, "other", model.Viewer{})
+	b.Unsubscribe("r", first)
+	subscribe(t, b, "r", model.Viewer{})
+}
+
+func TestStreamOnlySendsRollsTheViewerMaySee(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{})
+	viewers := map[string]model.Viewer{
+		"roller": {PlayerID: "p1", Name: "ann"},
+		// Another player taking the roller's name does not see the whisper.
+		"other": {PlayerID: "p2", Name: "ann"},
+		"gm":    {PlayerID: "p3", Name: "dm", GM: true},
+	}
+	outs := map[string]*streamBuffer{}
+	dones := map[string]chan struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	for who, viewer := range viewers {
+		outs[who], dones[who] = runStream(ctx, b, subscribe(t, b, "r", viewer), nil, 0)
+	}
+
+	for _, entry := range []model.LogEntry{
+		{Seq: 1, User: "ann", PlayerID: "p1", Result: 11, Visibility: model.VisibilityWhisper},
+		{Seq: 2, User: "dm", PlayerID: "p3", Result: 12, Visibility: model.VisibilityGM},
+		{Seq: 3, User: "ann", PlayerID: "p2", Result: 13},
+	} {
+		ev, err := newRollEvent("r", &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Send("r", ev)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for _, out := range outs {
+		for !strings.Contains(out.String(), `"result":13`) && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	cancel()
+	for who, done := range dones {
+		waitFor(t, done, who+"'s stream to end")
+	}
+
+	for who, want := range map[string][]string{
+		"roller": {`"result":11`, `"seq":2,"user":"dm","visibility":"gm","hidden":true`, `"result":13`},
+		"other":  {`"seq":2,"user":"dm","visibility":"gm","hidden":true`, `"result":13`},
+		"gm":     {`"result":11`, `"result":12`, `"result":13`},
+	} {
+		got := outs[who].String()
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s's stream is missing %s:\n%s", who, w, got)
+			}
+		}
+		if n := strings.Count(got, "data: "); n != len(want) {
+			t.Errorf("%s got %d events, want %d:\n%s", who, n, len(want), got)
+		}
+	}
+}
+
+func TestKickEndsOnlyTheKickedPlayersStream(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kickedOut, kickedDone := runStream(ctx, b, subscribe(t, b, "r", model.Viewer{PlayerID: "p1", Name: "ann"}), nil, 0)
+	otherOut, otherDone := runStream(ctx, b, subscribe(t, b, "r", model.Viewer{}), nil, 0)
+
+	ev, err := newKickEvent("r", "p1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Send("r", ev)
+	waitFor(t, kickedDone, "kicked player's stream to end")
+	if !strings.HasSuffix(kickedOut.String(), `data: {"type":"kick","roomId":"r","payload":{"banned":true}}`+"\n\n") {
+		t.Errorf("kicked stream = %q, want it to end with the kick", kickedOut.String())
+	}
+
+	select {
+	case <-otherDone:
+		t.Fatal("a stream without a player ended on someone else's kick")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+	waitFor(t, otherDone, "other stream to end")
+	if strings.Contains(otherOut.String(), "kick") {
+		t.Errorf("other stream was sent the kick: %q", otherOut.String())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dice_room/model"
+	"encoding/hex"
+	"net/http"
+)
+
+// gmCookie holds the key that makes its holder the GM of a room. Only the
+// key's hash is stored with the room.
+const gmCookie = "gm"
+
+// newGMKey makes the key for a new room's GM and the hash to store.
+func newGMKey() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = hex.EncodeToString(b)
+	return key, hashGMKey(key), nil
+}
+
+func hashGMKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isGM reports whether the request carries the room's GM key.
+func isGM(r *http.Request, room *model.Room) bool {
+	if room.GMKey == "" {
+		return false
+	}
+	cookie, err := r.Cookie(gmCookie)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashGMKey(cookie.Value)), []byte(room.GMKey)) == 1
+}
+
+// viewerFor is who a request for the room comes from.
+func (s *Server) viewerFor(r *http.Request, room *model.Room) model.Viewer {
+	sess, _ := s.session(r, room.Id)
+	return model.Viewer{PlayerID: sess.Player, Name: sess.Name, GM: isGM(r, room)}
+}
+
+// showAll is rolls as viewer may see them, without those they may not know of.
+func showAll(viewer model.Viewer, rolls []model.LogEntry) []model.LogEntry {
+	shown := make([]model.LogEntry, 0, len(rolls))
+	for _, e := range rolls {
+		if e, ok := viewer.Show(e); ok {
+			shown = append(shown, e)
+		}
+	}
+	return shown
+}
+
+// rollVisibility is who may see a roll the viewer asked to keep secret or to
+// whisper. Only the GM rolls in secret; a GM's whisper is a secret roll too.
+func rollVisibility(viewer model.Viewer, secret, whisper bool) string {
+	switch {
+	case viewer.GM && (secret || whisper):
+		return model.VisibilityGM
+	case whisper:
+		return model.VisibilityWhisper
+	default:
+		return model.VisibilityPublic
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"dice_room/dice"
+	"dice_room/store"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roomPoster returns a func that posts a room form to s with a valid CSRF
+// token, and any cookies given, and returns the status.
+func roomPoster(t *testing.T, s *Server) func(roomID string, form url.Values, cookies ...*http.Cookie) int {
+	t.Helper()
+	page := httptest.NewRecorder()
+	token, err := s.csrfToken(page, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(roomID string, form url.Values, cookies ...*http.Cookie) int {
+		form.Set(csrfField, token)
+		req := httptest.NewRequest("POST", "/room/"+roomID, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range append(page.Result().Cookies(), cookies...) {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+}
+
+func TestOnlyTheGMManagesDiceAndSeed(t *testing.T) {
+	st := store.NewMemoryStore()
+	b := NewLocalBroadcaster(StreamConfig{})
+	// Seeds are only revealed where rolls are provably fair.
+	s := NewServer(st, b, NewPresence(b, 0), NewSigner([]byte("test secret")), NewLimits(LimitConfig{}), dice.CryptoRoller{}, "", false)
+	key, hash, err := newGMKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withGM, _ := st.CreateRoom("gm", dice.NewServerSeed(), hash, "")
+	withoutGM, _ := st.CreateRoom("old", dice.NewServerSeed(), "", "")
+	post := roomPoster(t, s)
+	gm := &http.Cookie{Name: gmCookie, Value: key}
+
+	for _, action := range []string{"customDie", "revealSeed"} {
+		form := func() url.Values {
+			return url.Values{"action": {action}, "dieName": {"loc"}, "faces": {"Head, Torso"}}
+		}
+		if code := post(withGM.Id, form()); code != http.StatusForbidden {
+			t.Errorf("%s by a player: status %d, want 403", action, code)
+		}
+		if code := post(withGM.Id, form(), gm); code != http.StatusSeeOther {
+			t.Errorf("%s by the GM: status %d, want 303", action, code)
+		}
+		if code := post(withoutGM.Id, form()); code != http.StatusSeeOther {
+			t.Errorf("%s in a room without a GM: status %d, want 303", action, code)
+		}
+	}
+	room, _ := st.GetRoom(withGM.Id)
+	if len(room.CustomDice) != 1 || len(room.Seeds) != 2 {
+		t.Errorf("room has %d custom dice and %d seeds, want only the GM's die and seed", len(room.CustomDice), len(room.Seeds))
+	}
+}
+
+func TestDiceAndSeedShareTheRollLimit(t *testing.T) {
+	st := store.NewMemoryStore()
+	b := NewLocalBroadcaster(StreamConfig{})
+	limits := NewLimits(LimitConfig{Roll: Rate{Events: 1, Per: time.Hour}})
+	s := NewServer(st, b, NewPresence(b, 0), NewSigner([]byte("test secret")), limits, dice.CryptoRoller{}, "", false)
+	room, _ := st.CreateRoom("old", dice.NewServerSeed(), "", "")
+	post := roomPoster(t, s)
+
+	if code := post(room.Id, url.Values{"action": {"customDie"}, "dieName": {"loc"}, "faces": {"Head, Torso"}}); code != http.StatusSeeOther {
+		t.Fatalf("first custom die: status %d, want 303", code)
+	}
+	if code := post(room.Id, url.Values{"action": {"customDie"}, "dieName": {"hit"}, "faces": {"Arm, Leg"}}); code != http.StatusTooManyRequests {
+		t.Errorf("second custom die: status %d, want 429", code)
+	}
+	if code := post(room.Id, url.Values{"action": {"revealSeed"}}); code != http.StatusTooManyRequests {
+		t.Errorf("seed reveal after the limit: status %d, want 429", code)
+	}
+	if got, _ := st.GetRoom(room.Id); len(got.CustomDice) != 1 || len(got.Seeds) != 1 {
+		t.Errorf("room has %d custom dice and %d seeds, want what came before the limit", len(got.CustomDice), len(got.Seeds))
+	}
+}
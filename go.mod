@@ -3,8 +3,8 @@ module dice_room
 go 1.25.0
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/vixac/bullet v0.2.5
 	github.com/vixac/firbolg_clients v0.2.15
 )
-
-require github.com/mattn/go-sqlite3 v1.14.32 // indirect
@@ -1,34 +1,63 @@
 package main
 
 import (
+	"dice_room/dice"
 	"dice_room/model"
 	"dice_room/store"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// maxClientSeedLength caps the client seed a browser may send with a roll.
+const maxClientSeedLength = 64
+
+// roomPageSize is how many rolls the room page shows before "Load older".
+const roomPageSize = 50
+
 func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("indexHandler: %s %s", r.Method, r.URL.String())
 	if r.Method == http.MethodPost {
+		if ok, wait := s.limits.createRoom.Allow(s.limits.clientIP(r)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
 		r.ParseForm()
 		roomName := strings.TrimSpace(r.FormValue("roomName"))
-		room, err := s.store.CreateRoom(roomName)
+		gmKey, gmHash, err := newGMKey()
 		if err != nil {
 			http.Error(w, "Could not create room", http.StatusInternalServerError)
 			return
 		}
+		passphrase := ""
+		if p := r.FormValue("passphrase"); p != "" {
+			if passphrase, err = hashPassphrase(p); err != nil {
+				http.Error(w, "Could not create room", http.StatusInternalServerError)
+				return
+			}
+		}
+		room, err := s.store.CreateRoom(roomName, s.newRoomSeed(), gmHash, passphrase)
+		if err != nil {
+			http.Error(w, "Could not create room", http.StatusInternalServerError)
+			return
+		}
+		// Whoever creates the room runs it.
+		s.setRoomCookie(w, r, room.Id, gmCookie, gmKey)
 		http.Redirect(w, r, s.prefixFor(r)+"/room/"+room.Id, http.StatusSeeOther)
 		return
 	}
 
-	if err := s.templates.ExecuteTemplate(w, "index.html", model.PageData{HostPrefix: s.prefixFor(r)}); err != nil {
+	page, err := s.formPage(w, r)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.templates.ExecuteTemplate(w, "index.html", page); err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 	}
 }
@@ -36,6 +65,10 @@ func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) roomHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("roomHandler: %s %s", r.Method, r.URL.String())
 	roomID := r.URL.Path[len("/room/"):]
+	if id, ok := strings.CutSuffix(roomID, "/verify"); ok {
+		s.verifyHandler(w, r, id)
+		return
+	}
 
 	room, err := s.store.GetRoom(roomID)
 	if err != nil {
@@ -48,78 +81,469 @@ func (s *Server) roomHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !s.gateRoom(w, r, room) {
+		return
+	}
 
-	userName := ""
-	if cookie, err := r.Cookie("username"); err == nil {
-		userName = cookie.Value
+	viewer, ok, err := s.admit(r, room)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You have been banned from this room", http.StatusForbidden)
+		return
 	}
+	gm := viewer.GM
+	// Rooms made before GMs existed have none, so anyone in them manages
+	// the dice and the seed.
+	manage := gm || room.GMKey == ""
 
 	if r.Method == http.MethodPost {
 		action := r.FormValue("action")
 		switch action {
+		case "kick", "ban", "unban":
+			s.moderate(w, r, roomID, viewer)
+			return
+
 		case "join":
-			userName = r.FormValue("name")
-			http.SetCookie(w, &http.Cookie{
-				Name:     "username",
-				Value:    userName,
-				Path:     s.prefixFor(r) + "/room/" + roomID,
-				HttpOnly: true,
-				Secure:   s.secureCookies,
-				SameSite: http.SameSiteLaxMode,
-			})
+			name := cleanName(r.FormValue("name"))
+			if name == "" {
+				http.Error(w, "Enter a name", http.StatusBadRequest)
+				return
+			}
+			// Renaming keeps the player id, so their whispers stay theirs.
+			if viewer.PlayerID == "" {
+				if viewer.PlayerID, err = newPlayerID(); err != nil {
+					http.Error(w, "Internal error", http.StatusInternalServerError)
+					return
+				}
+			}
+			viewer.Name = name
 
 		case "roll":
 			desc := r.FormValue("desc")
-			diceType := r.FormValue("dice")
-
-			sides := 20
-			if diceType != "" {
-				if parsed, err := strconv.Atoi(diceType[1:]); err == nil {
-					sides = parsed
-				}
+			// A typed expression wins over the dice picker; picker values are valid notation too.
+			expr := strings.TrimSpace(r.FormValue("expr"))
+			if expr == "" {
+				expr = r.FormValue("dice")
 			}
-
-			now := time.Now()
-			entry := model.LogEntry{
-				User:       userName,
-				Dice:       diceType,
-				Result:     rand.Intn(sides) + 1,
-				Desc:       desc,
-				Time:       now.Format("15:04:05"),
-				UnixMillis: now.UnixMilli(),
+			if expr == "" {
+				expr = "d20"
 			}
 
-			if err := s.store.AddEntry(roomID, entry); err != nil {
-				http.Error(w, "Could not record roll", http.StatusInternalServerError)
+			if viewer.Name == "" {
+				http.Error(w, "Join the room before rolling", http.StatusForbidden)
 				return
 			}
-
-			if b, err := json.Marshal(entry); err == nil {
-				s.broadcaster.Send(roomID, string(b))
+			if ok, wait := s.limits.allowRoll(s.limits.clientIP(r), roomID); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+			visibility := rollVisibility(viewer, r.FormValue("secret") != "", r.FormValue("whisper") != "")
+			entry, err := s.rollDice(room, viewer, expr, desc, r.FormValue("clientSeed"), visibility)
+			if err != nil {
+				if errors.Is(err, dice.ErrInvalidExpression) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, "Could not record roll", http.StatusInternalServerError)
+				}
+				return
 			}
+			s.broadcastEntry(roomID, entry)
 
 			redirect := s.prefixFor(r) + "/room/" + roomID
 			fmt.Printf(" redirecting to %s\n", redirect)
 			// Post/Redirect/Get: prevents double-roll on browser refresh.
 			http.Redirect(w, r, redirect, http.StatusSeeOther)
 			return
+
+		case "chat":
+			if viewer.Name == "" {
+				http.Error(w, "Join the room before chatting", http.StatusForbidden)
+				return
+			}
+			if ok, wait := s.limits.allowRoll(s.limits.clientIP(r), roomID); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+			if err := s.sendChat(roomID, viewer, r.FormValue("text")); err != nil {
+				if errors.Is(err, errEmptyChat) {
+					http.Error(w, "Say something first", http.StatusBadRequest)
+				} else {
+					http.Error(w, "Could not send message", http.StatusInternalServerError)
+				}
+				return
+			}
+			http.Redirect(w, r, s.prefixFor(r)+"/room/"+roomID, http.StatusSeeOther)
+			return
+
+		case "revealRoll":
+			if !gm {
+				http.Error(w, "Only the GM can reveal rolls", http.StatusForbidden)
+				return
+			}
+			seq, err := strconv.ParseInt(r.FormValue("seq"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid roll", http.StatusBadRequest)
+				return
+			}
+			entry, err := s.store.RevealRoll(roomID, seq)
+			if err != nil {
+				if errors.Is(err, store.ErrRollNotFound) {
+					http.Error(w, "Roll not found", http.StatusNotFound)
+				} else {
+					http.Error(w, "Could not reveal roll", http.StatusInternalServerError)
+				}
+				return
+			}
+			s.broadcastReveal(roomID, entry)
+			http.Redirect(w, r, s.prefixFor(r)+"/room/"+roomID, http.StatusSeeOther)
+			return
+
+		case "revealSeed":
+			if !manage {
+				http.Error(w, "Only the GM can reveal the seed", http.StatusForbidden)
+				return
+			}
+			if !s.fair {
+				http.Error(w, "Rolls here are not provably fair", http.StatusBadRequest)
+				return
+			}
+			if ok, wait := s.limits.allowRoll(s.limits.clientIP(r), roomID); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+			if err := s.store.RotateSeed(roomID, dice.NewServerSeed()); err != nil {
+				http.Error(w, "Could not reveal seed", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, s.prefixFor(r)+"/room/"+roomID+"/verify", http.StatusSeeOther)
+			return
+
+		case "customDie":
+			if !manage {
+				http.Error(w, "Only the GM can add custom dice", http.StatusForbidden)
+				return
+			}
+			if ok, wait := s.limits.allowRoll(s.limits.clientIP(r), roomID); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+			die, err := dice.ParseCustomDie(r.FormValue("dieName"), r.FormValue("faces"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.store.SaveCustomDie(roomID, *die); err != nil {
+				http.Error(w, "Could not save die", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, s.prefixFor(r)+"/room/"+roomID, http.StatusSeeOther)
+			return
 		}
 	}
 
-	// Copy log under lock so we don't hold it during template rendering.
+	recent, err := s.store.RecentRolls(roomID, 0, roomPageSize)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	var olderBefore int64
+	if len(recent) == roomPageSize {
+		olderBefore = recent[len(recent)-1].Seq
+	}
+
 	room.Lock.Lock()
-	logSnapshot := make([]model.LogEntry, len(room.Log))
-	copy(logSnapshot, room.Log)
+	customDice := room.CustomDice
+	seedHash := ""
+	if seed := s.currentSeed(room); seed != nil {
+		seedHash = seed.Hash
+	}
 	room.Lock.Unlock()
 
+	if viewer.Name != "" {
+		// Renewed on every visit, so a session only lapses in rooms left alone.
+		sess := session{Room: roomID, Player: viewer.PlayerID, Name: viewer.Name}
+		if err := s.setSession(w, r, sess); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	inviteLink := ""
+	if gm && room.Passphrase != "" {
+		if inviteLink, err = s.inviteLink(r, roomID); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	var roster []model.Player
+	var bans []model.Ban
+	if gm {
+		if bans, err = s.roomBans(roomID); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		roster = members(s.presence.Members(roomID), recent, bans, viewer)
+		bans = activeBans(bans)
+	}
+
+	page, err := s.formPage(w, r)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
 	data := model.RoomData{
+		PageData:    page,
+		ID:          roomID,
+		RoomName:    room.RoomName,
+		Log:         showAll(viewer, recent),
+		UserName:    viewer.Name,
+		DiceTypes:   dice.DiceTypes(customDice),
+		CustomDice:  customDice,
+		SeedHash:    seedHash,
+		OlderBefore: olderBefore,
+		Players:     s.presence.Players(roomID),
+		IsGM:        gm,
+		CanManage:   manage,
+		InviteLink:  inviteLink,
+		Members:     roster,
+		Bans:        bans,
+	}
+	s.templates.ExecuteTemplate(w, "room.html", data)
+}
+
+// roomCookiePaths are where a room's cookies must reach: its page, its live
+// streams and its API.
+var roomCookiePaths = []string{"/room/", "/events/", "/ws/", "/api/v1/rooms/"}
+
+// setRoomCookie sets a cookie for every path that serves the room.
+func (s *Server) setRoomCookie(w http.ResponseWriter, r *http.Request, roomID, name, value string) {
+	for _, path := range roomCookiePaths {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     s.prefixFor(r) + path + roomID,
+			HttpOnly: true,
+			Secure:   s.secureCookies,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// newRoomSeed is the seed for a new room, or a zero seed if this server does
+// not make provably fair rolls.
+func (s *Server) newRoomSeed() model.ServerSeed {
+	if !s.fair {
+		return model.ServerSeed{}
+	}
+	return dice.NewServerSeed()
+}
+
+// currentSeed is the seed the room's rolls are drawn from, or nil if they are
+// not provably fair. The caller holds room.Lock.
+func (s *Server) currentSeed(room *model.Room) *model.ServerSeed {
+	if !s.fair {
+		return nil
+	}
+	return room.CurrentSeed()
+}
+
+// rollDice evaluates expr for the room as player and records the entry. Rooms
+// with a server seed roll provably fair; older rooms, and every room when the
+// server has a seeded roller, use the server's roller.
+func (s *Server) rollDice(room *model.Room, player model.Viewer, expr, desc, clientSeed, visibility string) (*model.LogEntry, error) {
+	room.Lock.Lock()
+	customDice := room.CustomDice
+	var seed model.ServerSeed
+	hasSeed := false
+	if cur := s.currentSeed(room); cur != nil {
+		seed = *cur
+		hasSeed = true
+	}
+	room.Lock.Unlock()
+
+	if hasSeed {
+		clientSeed = strings.TrimSpace(clientSeed)
+		if clientSeed == "" || len(clientSeed) > maxClientSeedLength {
+			clientSeed = dice.NewClientSeed()
+		}
+	}
+
+	// A fair roll's nonce is its Seq, which the store gives no other roll in
+	// the room, so no two rolls from one seed and client seed share a nonce.
+	return s.store.AddEntryFor(room.Id, func(seq int64) (model.LogEntry, error) {
+		roller := s.roller
+		var proof *model.Proof
+		if hasSeed {
+			fair := dice.NewFairRoller(seed.Seed, clientSeed, int(seq))
+			roller = fair
+			proof = &model.Proof{
+				SeedHash:   seed.Hash,
+				ClientSeed: clientSeed,
+				Nonce:      int(seq),
+				Digest:     fair.Digest(),
+			}
+		}
+
+		res, err := dice.Roll(expr, roller, customDice)
+		if err != nil {
+			return model.LogEntry{}, err
+		}
+		if proof != nil {
+			proof.Dice = dice.CustomDiceUsed(res.Groups, customDice)
+		}
+
+		now := time.Now()
+		return model.LogEntry{
+			User:     player.Name,
+			PlayerID: player.PlayerID,
+			// Only the API rolls for someone with no session, under a name of their choosing.
+			API:        player.PlayerID == "",
+			Visibility: visibility,
+			Dice:       res.DieType(),
+			Expression: res.Expression,
+			Result:     res.Total,
+			Pool:       res.Pool,
+			Groups:     res.Groups,
+			Proof:      proof,
+			Desc:       desc,
+			Time:       now.Format("15:04:05"),
+			UnixMillis: now.UnixMilli(),
+		}, nil
+	})
+}
+
+// broadcastEntry sends a recorded roll to the room's live subscribers.
+func (s *Server) broadcastEntry(roomID string, entry *model.LogEntry) {
+	ev, err := newRollEvent(roomID, entry)
+	if err != nil {
+		log.Printf("broadcast: encode entry: %v", err)
+		return
+	}
+	s.broadcaster.Send(roomID, ev)
+}
+
+// broadcastReveal shows everyone a secret or whispered roll the GM has revealed.
+func (s *Server) broadcastReveal(roomID string, entry *model.LogEntry) {
+	ev, err := newEvent(model.RoomEvent{Type: model.EventReveal, RoomID: roomID, Payload: entry})
+	if err != nil {
+		log.Printf("broadcast: encode reveal: %v", err)
+		return
+	}
+	s.broadcaster.Send(roomID, ev)
+}
+
+// rollsUntil pages back from the newest roll in a room until stop reports
+// true for one, and returns the rolls newer than that one, oldest first.
+func rollsUntil(st store.Store, roomID string, stop func(model.LogEntry) bool) ([]model.LogEntry, error) {
+	rolls := []model.LogEntry{}
+	var before int64
+	for {
+		page, err := st.RecentRolls(roomID, before, roomPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			if stop(e) {
+				slices.Reverse(rolls)
+				return rolls, nil
+			}
+			rolls = append(rolls, e)
+		}
+		if len(page) < roomPageSize {
+			slices.Reverse(rolls)
+			return rolls, nil
+		}
+		before = page[len(page)-1].Seq
+	}
+}
+
+// allRolls pages through every roll in a room, oldest first.
+func (s *Server) allRolls(roomID string) ([]model.LogEntry, error) {
+	return rollsUntil(s.store, roomID, func(model.LogEntry) bool { return false })
+}
+
+// verifyHandler lists every roll in a room with whether it checks out against
+// its revealed server seed.
+func (s *Server) verifyHandler(w http.ResponseWriter, r *http.Request, roomID string) {
+	room, err := s.store.GetRoom(roomID)
+	if err != nil {
+		if errors.Is(err, store.ErrRoomNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			s.templates.ExecuteTemplate(w, "not_found.html", model.PageData{HostPrefix: s.prefixFor(r)})
+		} else {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !s.gateRoom(w, r, room) {
+		return
+	}
+
+	logSnapshot, err := s.allRolls(roomID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	room.Lock.Lock()
+	customDice := room.CustomDice
+	// Never hand an unrevealed seed to the template.
+	seeds := make([]model.ServerSeed, len(room.Seeds))
+	revealed := make(map[string]string)
+	for i, seed := range room.Seeds {
+		if seed.Revealed {
+			revealed[seed.Hash] = seed.Seed
+		} else {
+			seed.Seed = ""
+		}
+		seeds[i] = seed
+	}
+	room.Lock.Unlock()
+
+	viewer, ok, err := s.admit(r, room)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You have been banned from this room", http.StatusForbidden)
+		return
+	}
+	rows := make([]model.VerifyRow, 0, len(logSnapshot))
+	for _, entry := range logSnapshot {
+		row := model.VerifyRow{Entry: entry, Status: "unproven"}
+		if !viewer.Sees(entry) {
+			redacted, ok := entry.Redacted()
+			if !ok {
+				continue
+			}
+			row = model.VerifyRow{Entry: redacted, Status: "secret"}
+		} else if entry.Proof != nil {
+			seed, ok := revealed[entry.Proof.SeedHash]
+			switch {
+			case !ok:
+				row.Status = "pending"
+			case dice.Verify(entry, seed, customDice):
+				row.Status = "verified"
+			default:
+				row.Status = "mismatch"
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	data := model.VerifyData{
 		PageData: model.PageData{HostPrefix: s.prefixFor(r)},
 		ID:       roomID,
 		RoomName: room.RoomName,
-		Log:      logSnapshot,
-		UserName: userName,
+		Seeds:    seeds,
+		Rows:     rows,
+	}
+	if err := s.templates.ExecuteTemplate(w, "verify.html", data); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
 	}
-	s.templates.ExecuteTemplate(w, "room.html", data)
 }
 
 func (s *Server) privacyHandler(w http.ResponseWriter, r *http.Request) {
@@ -140,6 +564,41 @@ func (s *Server) contactHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// replayAfter encodes the rolls a client that has seen up to lastID missed.
+// A lastID of 0 means a client with nothing to catch up on.
+func (s *Server) replayAfter(roomID string, lastID int64) ([]Event, error) {
+	if lastID <= 0 {
+		return nil, nil
+	}
+	missed, err := rollsUntil(s.store, roomID, func(e model.LogEntry) bool { return e.Seq <= lastID })
+	if err != nil {
+		return nil, err
+	}
+	replay := make([]Event, 0, len(missed))
+	for _, e := range missed {
+		ev, err := newRollEvent(roomID, &e)
+		if err != nil {
+			return nil, err
+		}
+		replay = append(replay, ev)
+	}
+	return replay, nil
+}
+
+// lastEventID is the Seq of the last roll the client has seen. A reconnecting
+// EventSource sends it as Last-Event-ID; on first connect the page passes the
+// newest roll it rendered as ?after=.
+func lastEventID(r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("after")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
 func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
 	roomID := strings.TrimPrefix(r.URL.Path, "/events/")
 
@@ -148,20 +607,56 @@ func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
 		return
 	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+	room, err := s.store.GetRoom(roomID)
+	if err != nil {
+		if errors.Is(err, store.ErrRoomNotFound) {
+			http.Error(w, "Room not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !s.canEnter(r, room) {
+		http.Error(w, "Room is locked", http.StatusForbidden)
+		return
+	}
+
+	viewer, ok, err := s.admit(r, room)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You have been banned from this room", http.StatusForbidden)
+		return
+	}
+
+	// Subscribe before reading the store so that a roll recorded in between
+	// arrives live; Stream skips anything the replay already covered.
+	sub, err := s.broadcaster.Subscribe(roomID, viewer)
+	if err != nil {
+		tooManyRequests(w, roomFullRetry)
+		return
+	}
+	defer s.broadcaster.Unsubscribe(roomID, sub)
+
+	replay, err := s.replayAfter(roomID, lastID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if viewer.Name != "" {
+		defer s.openStream(roomID, viewer, s.limits.clientIP(r))()
+	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	ch := s.broadcaster.Subscribe(roomID)
-
-	go func() {
-		<-r.Context().Done()
-		s.broadcaster.Unsubscribe(roomID, ch)
-	}()
-
-	for msg := range ch {
-		fmt.Fprintf(w, "data: %s\n\n", msg)
-		flusher.Flush()
-	}
+	s.broadcaster.Stream(r.Context(), sseWriter{w: w, flush: flusher.Flush}, sub, replay, lastID)
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"dice_room/dice"
+	"dice_room/model"
+	"dice_room/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPageChecksEachRoll(t *testing.T) {
+	st := store.NewMemoryStore()
+	b := NewLocalBroadcaster(StreamConfig{})
+	s := NewServer(st, b, NewPresence(b, 0), NewSigner([]byte("test secret")), NewLimits(LimitConfig{}), dice.CryptoRoller{}, "", false)
+	room, err := st.CreateRoom("r", dice.NewServerSeed(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := dice.ParseCustomDie("loc", "Head, Torso, Arm, Leg")
+	if err := st.SaveCustomDie(room.Id, *loc); err != nil {
+		t.Fatal(err)
+	}
+	ann := model.Viewer{Name: "ann", PlayerID: "p1"}
+	if _, err := s.rollDice(room, ann, "4d6!", "", "c", model.VisibilityPublic); err != nil {
+		t.Fatal(err)
+	}
+	custom, err := s.rollDice(room, ann, "3d{loc}", "", "c", model.VisibilityPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *custom
+	forged.Result++
+	if err := st.AddEntry(room.Id, &forged); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AddEntry(room.Id, &model.LogEntry{User: "old", Dice: "d6", Result: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := func() map[string]int {
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/room/"+room.Id+"/verify", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("verify page: status %d", rec.Code)
+		}
+		counts := make(map[string]int)
+		for _, status := range []string{"pending", "verified", "mismatch", "unproven"} {
+			counts[status] = strings.Count(rec.Body.String(), `class="verify-row `+status+`"`)
+		}
+		return counts
+	}
+
+	if got := statuses(); got["pending"] != 3 || got["unproven"] != 1 {
+		t.Errorf("before the seed is revealed: %v, want 3 pending and 1 unproven", got)
+	}
+	// Redefining a die after rolling it does not change how the roll checks out.
+	redefined, _ := dice.ParseCustomDie("loc", "Head=10, Torso=20, Arm=30, Leg=40")
+	if err := st.SaveCustomDie(room.Id, *redefined); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RotateSeed(room.Id, dice.NewServerSeed()); err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(); got["verified"] != 2 || got["mismatch"] != 1 || got["unproven"] != 1 || got["pending"] != 0 {
+		t.Errorf("after the seed is revealed: %v, want 2 verified, 1 mismatch and 1 unproven", got)
+	}
+}
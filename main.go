@@ -1,21 +1,30 @@
 package main
 
 import (
+	"context"
+	"dice_room/dice"
 	"dice_room/store"
 	"dice_room/store/bullet_store"
+	"dice_room/store/sqlite_store"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/vixac/bullet/store/store_interface"
 
 	"github.com/vixac/firbolg_clients/bullet/rest_bullet"
 )
 
+// shutdownTimeout bounds how long in-flight requests get to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func buildMemoryStore() *store.MemoryStore {
-	fmt.Printf("Building memory store")
+	fmt.Printf("Building memory store\n")
 	return store.NewMemoryStore()
 }
 
@@ -39,6 +48,63 @@ func buildBullet(bulletPort int) store.Store {
 	return store
 }
 
+func buildSqlite(dbPath string) store.Store {
+	fmt.Printf("Building sqlite store at %s\n", dbPath)
+	store, err := sqlite_store.NewSqliteStore(dbPath)
+	if err != nil {
+		log.Fatal("Error opening sqlite store: ", err)
+	}
+	return store
+}
+
+// buildStore builds the backend chosen with --store. ReadArgs has already
+// checked the flags that backend needs.
+func buildStore(args *Args) store.Store {
+	switch args.Store {
+	case "memory":
+		return buildMemoryStore()
+	case "sqlite":
+		return buildSqlite(args.DbPath)
+	default:
+		return buildBullet(args.BulletPort)
+	}
+}
+
+// buildBroadcaster builds the live update backend chosen with --broadcast.
+func buildBroadcaster(args *Args, st store.Store) Broadcaster {
+	local := NewLocalBroadcaster(args.Stream)
+	if args.Broadcast == "poll" {
+		fmt.Printf("Sharing live events between instances by polling the store every %s\n", args.PollEvery)
+		return NewPollingBroadcaster(local, st, args.PollEvery)
+	}
+	return local
+}
+
+func buildRoller(args *Args) dice.Roller {
+	if args.Roller == "seeded" {
+		fmt.Printf("Building seeded roller with seed %d\n", args.Seed)
+		return dice.NewSeededRoller(args.Seed)
+	}
+	return dice.CryptoRoller{}
+}
+
+// buildSigner signs with --secret, or with a random key if there is none,
+// and still accepts what --oldSecrets signed.
+func buildSigner(args *Args) *Signer {
+	if args.Secret != "" {
+		keys := [][]byte{[]byte(args.Secret)}
+		for _, old := range args.OldSecrets {
+			keys = append(keys, []byte(old))
+		}
+		return NewSigner(keys...)
+	}
+	key, err := newSecret()
+	if err != nil {
+		log.Fatal("Error making a signing key: ", err)
+	}
+	return NewSigner(key)
+}
+
 func main() {
 
 	fmt.Printf("Dice Room begins...\n")
@@ -47,13 +113,37 @@ func main() {
 		log.Fatal("Error parsing args: ", err)
 	}
 
-	broadcaster := NewBroadcaster()
-
-	store := buildBullet(args.BulletPort)
-	srv := NewServer(store, broadcaster, args.HostPrefix, !args.Dev)
+	store := buildStore(args)
+	broadcaster := buildBroadcaster(args, store)
+	presence := NewPresence(broadcaster, args.PresenceGrace)
+	if poller, ok := broadcaster.(*PollingBroadcaster); ok {
+		presence.Share(poller)
+	}
+	srv := NewServer(store, broadcaster, presence, buildSigner(args), NewLimits(args.Limits), buildRoller(args), args.HostPrefix, !args.Dev)
 
 	addr := ":" + strconv.Itoa(args.Port)
+	httpServer := &http.Server{Addr: addr, Handler: srv.routes()}
+	// Room streams never go idle on their own, so end them when shutdown starts.
+	httpServer.RegisterOnShutdown(broadcaster.Close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
 	log.Println("Listening on " + addr)
 	fmt.Println("Dice room is ready.")
-	log.Fatal(http.ListenAndServe(addr, srv.routes()))
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
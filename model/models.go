@@ -1,35 +1,426 @@
 package model
 
-import "sync"
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
 
-// Room holds the state for a single dice room.
+// Room holds the state for a single dice room. Its rolls are not loaded with
+// it; page through them with Store.RecentRolls.
 type Room struct {
-	Id       string
-	RoomName string
-	Log      []LogEntry
-	Lock     sync.Mutex
+	Id         string
+	RoomName   string
+	CustomDice []CustomDie
+	Seeds      []ServerSeed
+	// GMKey is the SHA-256 of the key held by the room's creator, who is its
+	// GM and owner, and the only one who may moderate it. It is empty for
+	// rooms without a GM.
+	GMKey string
+	// Passphrase is the hash of the passphrase needed to enter the room, or
+	// empty for a room open to anyone with the link.
+	Passphrase string
+	Lock       sync.Mutex
 }
 
-// LogEntry is one roll event. JSON tags are used for SSE broadcasting.
-type LogEntry struct {
+// CurrentSeed returns the seed new rolls are drawn from: the newest one not yet
+// revealed. It is nil for rooms created before provably fair rolls existed.
+// The caller must hold Lock.
+func (r *Room) CurrentSeed() *ServerSeed {
+	for i := len(r.Seeds) - 1; i >= 0; i-- {
+		if !r.Seeds[i].Revealed {
+			return &r.Seeds[i]
+		}
+	}
+	return nil
+}
+
+// ServerSeed is a room's provably fair seed. Seed is secret until Revealed;
+// before that only Hash may be shown to players.
+type ServerSeed struct {
+	Hash     string `json:"hash"`
+	Seed     string `json:"seed"`
+	Revealed bool   `json:"revealed,omitempty"`
+	Created  int64  `json:"created"`
+}
+
+// Proof records what a provably fair roll was drawn from. Digest is the first
+// HMAC block, so the roll can be checked once the seed with SeedHash is revealed.
+// Dice are the room's custom dice the roll used, as they were when it was
+// made, so redefining one later does not change how the roll checks out.
+type Proof struct {
+	SeedHash   string      `json:"seedHash"`
+	ClientSeed string      `json:"clientSeed"`
+	Nonce      int         `json:"nonce"`
+	Digest     string      `json:"digest"`
+	Dice       []CustomDie `json:"dice,omitempty"`
+}
+
+// CustomDie is a room-defined die with arbitrary faces, rolled as d{Name}.
+type CustomDie struct {
+	Name  string `json:"name"`
+	Faces []Face `json:"faces"`
+}
+
+// Face is one side of a custom die. Value is what the face adds to a total.
+type Face struct {
+	Label string `json:"label"`
+	Value int    `json:"value"`
+}
+
+// Types of RoomEvent.
+const (
+	// EventRoll carries a LogEntry.
+	EventRoll = "roll"
+	// EventResync tells a client it fell behind and must reload the room. No payload.
+	EventResync = "resync"
+	// EventError carries an ErrorPayload, sent only to the client whose message failed.
+	EventError = "error"
+	// EventReveal carries a secret LogEntry the GM has made public. It is
+	// not replayed; the roll's own event already was.
+	EventReveal = "reveal"
+	// EventJoin carries a PresencePayload when a player opens their first stream.
+	EventJoin = "join"
+	// EventLeave carries a PresencePayload once a player's streams have all
+	// been closed for longer than the reconnect grace period.
+	EventLeave = "leave"
+	// EventKick carries a KickPayload to the player the GM removed, whose
+	// stream then ends.
+	EventKick = "kick"
+	// EventChat carries a ChatPayload. Chat is not stored, so it is not replayed.
+	EventChat = "chat"
+	// EventPresence carries a PresencePayload with no User, sent to a
+	// WebSocket client in answer to its presence heartbeat, and to the room
+	// when the players present are relisted without anyone joining or leaving.
+	EventPresence = "presence"
+)
+
+// RoomEvent is the envelope for everything sent on a room's live stream.
+// Clients dispatch on Type. ID is the roll's Seq for roll events and 0 for
+// events that are not stored and so cannot be replayed.
+type RoomEvent struct {
+	Type    string `json:"type"`
+	ID      int64  `json:"id,omitempty"`
+	RoomID  string `json:"roomId"`
+	Payload any    `json:"payload,omitempty"`
+}
+
+// NewRollEvent wraps a recorded roll for the room's stream.
+func NewRollEvent(roomID string, entry *LogEntry) RoomEvent {
+	return RoomEvent{Type: EventRoll, ID: entry.Seq, RoomID: roomID, Payload: entry}
+}
+
+// ErrorPayload is the payload of an EventError.
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+// PresencePayload is the payload of EventJoin, EventLeave and EventPresence. Players is
+// everyone present after the change, sorted by name.
+type PresencePayload struct {
+	User    string   `json:"user"`
+	Players []string `json:"players"`
+}
+
+// ChatPayload is the payload of EventChat.
+type ChatPayload struct {
 	User       string `json:"user"`
-	Dice       string `json:"dice"`
-	Result     int    `json:"result"`
-	Desc       string `json:"desc,omitempty"`
+	Text       string `json:"text"`
 	Time       string `json:"time"`
 	UnixMillis int64  `json:"unixMillis"`
 }
 
+// KickPayload is the payload of EventKick. Banned is set if the player may
+// not come back.
+type KickPayload struct {
+	Banned bool `json:"banned"`
+}
+
+// Player is someone who has joined a room, as the GM's moderation panel
+// lists them.
+type Player struct {
+	ID   string
+	Name string
+	// Present is set while they have the room open.
+	Present bool
+}
+
+// Ban keeps a player out of a room: PlayerID matches their session, and IP,
+// if set, turns away anyone connecting from that address too. A Kick only
+// ends the session; its holder may join again as a new player.
+type Ban struct {
+	ID       string `json:"id"`
+	PlayerID string `json:"playerId,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	// Name is what the player was called when they were removed.
+	Name    string `json:"name"`
+	Kick    bool   `json:"kick,omitempty"`
+	Created int64  `json:"created"`
+}
+
+// Who may see a LogEntry.
+const (
+	// VisibilityPublic rolls are seen by everyone.
+	VisibilityPublic = ""
+	// VisibilityGM rolls are the GM's secret until revealed; everyone else
+	// only sees that the GM rolled.
+	VisibilityGM = "gm"
+	// VisibilityWhisper rolls are seen by the player who rolled and the GM,
+	// and not shown to anyone else at all.
+	VisibilityWhisper = "whisper"
+)
+
+// Viewer is who a room's log is being shown to. PlayerID and Name come from
+// their signed session and are empty if they have not joined.
+type Viewer struct {
+	PlayerID string
+	Name     string
+	GM       bool
+}
+
+// Sees reports whether v may see e in full.
+func (v Viewer) Sees(e LogEntry) bool {
+	switch e.Visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityWhisper:
+		return v.GM || (v.PlayerID != "" && v.PlayerID == e.PlayerID)
+	default:
+		return v.GM
+	}
+}
+
+// Show is e as v may see it, and false if v may not know of it at all.
+func (v Viewer) Show(e LogEntry) (LogEntry, bool) {
+	if v.Sees(e) {
+		return e, true
+	}
+	return e.Redacted()
+}
+
+// LogEntry is one roll. JSON tags are used for the API and the roll event payload.
+// Seq is assigned by the store and increases with every roll in a room.
+// PlayerID is the session of whoever rolled it, empty for API rolls and rolls
+// made before sessions existed. Visibility says who may see it; see Viewer.Show.
+type LogEntry struct {
+	Seq      int64  `json:"seq"`
+	User     string `json:"user"`
+	PlayerID string `json:"playerId,omitempty"`
+	// API marks a roll made through the JSON API by a caller with no player
+	// session. User is then only the name they gave, and belongs to no player.
+	API        bool         `json:"api,omitempty"`
+	Visibility string       `json:"visibility,omitempty"`
+	Hidden     bool         `json:"hidden,omitempty"`
+	Dice       string       `json:"dice"`
+	Expression string       `json:"expression,omitempty"`
+	Result     int          `json:"result"`
+	Pool       *PoolOutcome `json:"pool,omitempty"`
+	Groups     []DiceGroup  `json:"groups,omitempty"`
+	Proof      *Proof       `json:"proof,omitempty"`
+	Desc       string       `json:"desc,omitempty"`
+	Time       string       `json:"time"`
+	UnixMillis int64        `json:"unixMillis"`
+}
+
+// Redacted is what players who may not see e are shown, if anything. A GM's
+// secret roll shows that it was rolled and when, marked Hidden; a whisper
+// shows nothing.
+func (e LogEntry) Redacted() (LogEntry, bool) {
+	if e.Visibility == VisibilityWhisper {
+		return LogEntry{}, false
+	}
+	return LogEntry{
+		Seq:        e.Seq,
+		User:       e.User,
+		Visibility: e.Visibility,
+		Hidden:     true,
+		Time:       e.Time,
+		UnixMillis: e.UnixMillis,
+	}, true
+}
+
+// HasBreakdown reports whether the entry is worth showing die by die,
+// i.e. it is more than a single plain die.
+func (e LogEntry) HasBreakdown() bool {
+	if len(e.Groups) != 1 {
+		return len(e.Groups) > 1
+	}
+	g := e.Groups[0]
+	return len(g.Dice) > 1 || g.Total != e.Result || g.Dice[0].Label != ""
+}
+
+// DiceGroup is one NdX term of a dice expression and every die it threw.
+// For success-counting pools Total is the net number of successes.
+type DiceGroup struct {
+	Notation string       `json:"notation"`
+	Die      string       `json:"die"`
+	Sides    int          `json:"sides"`
+	Dice     []Die        `json:"dice"`
+	Total    int          `json:"total"`
+	Pool     *PoolOutcome `json:"pool,omitempty"`
+}
+
+// PoolOutcome summarises a success-counting roll such as 8d10>=7.
+// Failures are dice that cancel a success, e.g. ones in World of Darkness.
+type PoolOutcome struct {
+	Successes      int  `json:"successes"`
+	Failures       int  `json:"failures,omitempty"`
+	Botch          bool `json:"botch,omitempty"`
+	Glitch         bool `json:"glitch,omitempty"`
+	CriticalGlitch bool `json:"criticalGlitch,omitempty"`
+}
+
+// Summary describes the raw counts behind the net result, e.g. "3 successes, 1 botch, glitch".
+func (p *PoolOutcome) Summary() string {
+	parts := []string{plural(p.Successes, "success", "successes")}
+	if p.Failures > 0 {
+		parts = append(parts, plural(p.Failures, "botch", "botches"))
+	}
+	switch {
+	case p.CriticalGlitch:
+		parts = append(parts, "critical glitch")
+	case p.Glitch:
+		parts = append(parts, "glitch")
+	case p.Botch:
+		parts = append(parts, "botched")
+	}
+	return strings.Join(parts, ", ")
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return strconv.Itoa(n) + " " + many
+}
+
+// Die is a single thrown die. Dropped and rerolled dice are kept for display but do not count.
+// Label, when set, is shown instead of Value: a custom face, a Fudge symbol or a percentile split.
+type Die struct {
+	Value     int    `json:"value"`
+	Label     string `json:"label,omitempty"`
+	Dropped   bool   `json:"dropped,omitempty"`
+	Rerolled  bool   `json:"rerolled,omitempty"`
+	Exploded  bool   `json:"exploded,omitempty"`
+	Rolls     []int  `json:"rolls,omitempty"`
+	Unclamped int    `json:"unclamped,omitempty"`
+	Successes int    `json:"successes,omitempty"`
+	Failure   bool   `json:"failure,omitempty"`
+}
+
+// Text is what the log shows for the die.
+func (d Die) Text() string {
+	if d.Label != "" {
+		return d.Label
+	}
+	return strconv.Itoa(d.Value)
+}
+
+// Counts reports whether the die contributes to its group's total.
+func (d Die) Counts() bool {
+	return !d.Dropped && !d.Rerolled
+}
+
+// Classes returns the CSS classes used to render the die in the log.
+func (d Die) Classes() string {
+	classes := "die"
+	if d.Dropped {
+		classes += " dropped"
+	}
+	if d.Rerolled {
+		classes += " rerolled"
+	}
+	if d.Exploded {
+		classes += " exploded"
+	}
+	if len(d.Rolls) > 0 {
+		classes += " compounded"
+	}
+	if d.Unclamped != 0 {
+		classes += " clamped"
+	}
+	if d.Successes > 0 {
+		classes += " success"
+	}
+	if d.Successes > 1 {
+		classes += " double"
+	}
+	if d.Failure {
+		classes += " failure"
+	}
+	return classes
+}
+
+// Title explains a compounded or clamped value, e.g. "6+6+2" or "rolled 1".
+func (d Die) Title() string {
+	if len(d.Rolls) > 0 {
+		parts := make([]string, len(d.Rolls))
+		for i, r := range d.Rolls {
+			parts[i] = strconv.Itoa(r)
+		}
+		return strings.Join(parts, "+")
+	}
+	if d.Unclamped != 0 {
+		return "rolled " + strconv.Itoa(d.Unclamped)
+	}
+	return ""
+}
+
 // PageData is the base view model passed to all templates.
 type PageData struct {
 	HostPrefix string
+	// CSRF is the token forms that post back must carry, on pages that have them.
+	CSRF string
 }
 
 // RoomData is the view model passed to room.html.
 type RoomData struct {
+	PageData
+	ID         string
+	RoomName   string
+	Log        []LogEntry
+	UserName   string
+	DiceTypes  []string
+	CustomDice []CustomDie
+	SeedHash   string
+	// OlderBefore is the cursor for the page of rolls before Log, or 0 if Log reaches the first roll.
+	OlderBefore int64
+	// Players is who has the room open, as the sidebar first shows it.
+	Players []string
+	// IsGM is set for the room's GM, who may roll in secret.
+	IsGM bool
+	// CanManage is set for whoever may add custom dice and reveal the seed:
+	// the GM, or anyone in a room without one.
+	CanManage bool
+	// InviteLink is the path of an invite to a room with a passphrase, for its GM.
+	InviteLink string
+	// Members and Bans fill the GM's moderation panel.
+	Members []Player
+	Bans    []Ban
+}
+
+// LockedData is the view model passed to locked.html.
+type LockedData struct {
+	PageData
+	ID string
+	// Error says why the last attempt to get in failed.
+	Error string
+}
+
+// VerifyRow is one roll on the verify page. Status is "verified", "mismatch",
+// "pending" while its seed is still secret, "unproven" for rolls made
+// before provably fair rolls existed, or "secret" for a GM's roll the viewer
+// may not see.
+type VerifyRow struct {
+	Entry  LogEntry
+	Status string
+}
+
+// VerifyData is the view model passed to verify.html.
+type VerifyData struct {
 	PageData
 	ID       string
 	RoomName string
-	Log      []LogEntry
-	UserName string
+	Seeds    []ServerSeed
+	Rows     []VerifyRow
 }
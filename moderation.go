@@ -0,0 +1,268 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// banCacheTTL is how long a room's bans are kept before they are read
+	// again, and so how long a ban made on another instance may go unseen.
+	banCacheTTL = 5 * time.Second
+	// kickTTL is how long a kick is kept. The session it ended lapses
+	// sessionTTL after it was last renewed, which was before the kick.
+	kickTTL = sessionTTL
+)
+
+// banCache keeps each room's bans for banCacheTTL, so that pages, streams and
+// messages do not each read them all from the store. Bans made or lifted on
+// this instance drop the room's entry at once.
+type banCache struct {
+	mu    sync.Mutex
+	rooms map[string]cachedBans
+	// version counts the bans made or lifted here, so that a read that raced
+	// one is not cached.
+	version   uint64
+	lastSweep time.Time
+}
+
+type cachedBans struct {
+	bans    []model.Ban
+	expires time.Time
+}
+
+func newBanCache() *banCache {
+	return &banCache{rooms: make(map[string]cachedBans), lastSweep: time.Now()}
+}
+
+// get returns the room's cached bans, or false and the version to put them
+// back with.
+func (c *banCache) get(roomID string) ([]model.Ban, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.rooms[roomID]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, c.version, false
+	}
+	return cached.bans, c.version, true
+}
+
+// put caches bans read at version, unless a ban was made or lifted since.
+// Every so often it drops the rooms that have expired.
+func (c *banCache) put(roomID string, version uint64, bans []model.Ban) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > 12*banCacheTTL {
+		for id, cached := range c.rooms {
+			if now.After(cached.expires) {
+				delete(c.rooms, id)
+			}
+		}
+		c.lastSweep = now
+	}
+	if version == c.version {
+		c.rooms[roomID] = cachedBans{bans: bans, expires: now.Add(banCacheTTL)}
+	}
+}
+
+// forget drops a room's bans after one is made or lifted.
+func (c *banCache) forget(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	delete(c.rooms, roomID)
+}
+
+// newBanID makes the id the GM lifts a ban by.
+func newBanID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// barred checks a viewer connecting from ip against a room's bans. It reports
+// whether they are banned, and whether their session was ended by a kick, in
+// which case they are in the room as someone who has not joined. The GM is
+// never barred.
+func barred(bans []model.Ban, viewer model.Viewer, ip string) (banned, kicked bool) {
+	if viewer.GM {
+		return false, false
+	}
+	for _, ban := range bans {
+		ownSession := viewer.PlayerID != "" && ban.PlayerID == viewer.PlayerID
+		switch {
+		case ban.Kick:
+			kicked = kicked || ownSession
+		case ownSession, ban.IP != "" && ban.IP == ip:
+			return true, kicked
+		}
+	}
+	return false, kicked
+}
+
+// roomBans returns the room's bans, and its kicks younger than kickTTL. Older
+// kicks are lifted from the store as they are found.
+func (s *Server) roomBans(roomID string) ([]model.Ban, error) {
+	bans, version, ok := s.bans.get(roomID)
+	if ok {
+		return bans, nil
+	}
+	stored, err := s.store.Bans(roomID)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-kickTTL).UnixMilli()
+	bans = make([]model.Ban, 0, len(stored))
+	for _, ban := range stored {
+		if !ban.Kick || ban.Created >= cutoff {
+			bans = append(bans, ban)
+			continue
+		}
+		// Another instance may have lifted it first.
+		if err := s.store.LiftBan(roomID, ban.ID); err != nil && !errors.Is(err, store.ErrBanNotFound) {
+			log.Printf("moderation: lift expired kick: %v", err)
+		}
+	}
+	s.bans.put(roomID, version, bans)
+	return bans, nil
+}
+
+// admit is who a request for the room comes from, as viewerFor, once the
+// room's bans are applied. It reports false if they are banned.
+func (s *Server) admit(r *http.Request, room *model.Room) (model.Viewer, bool, error) {
+	viewer := s.viewerFor(r, room)
+	if viewer.GM {
+		return viewer, true, nil
+	}
+	bans, err := s.roomBans(room.Id)
+	if err != nil {
+		return model.Viewer{}, false, err
+	}
+	banned, kicked := barred(bans, viewer, s.limits.clientIP(r))
+	if kicked {
+		viewer = model.Viewer{}
+	}
+	return viewer, !banned, nil
+}
+
+// openStream marks a player's stream as open in the room and records the
+// address it came from, for a ban made on any instance to cover. It returns
+// the func to call when the stream closes.
+func (s *Server) openStream(roomID string, viewer model.Viewer, ip string) (leave func()) {
+	if err := s.store.SetPlayerIP(roomID, viewer.PlayerID, ip); err != nil {
+		log.Printf("moderation: record address: %v", err)
+	}
+	return s.presence.Join(roomID, model.Player{ID: viewer.PlayerID, Name: viewer.Name})
+}
+
+// removePlayer kicks a player out of the room, or bans them, and ends their
+// live streams. A ban also covers the address their latest stream came from.
+func (s *Server) removePlayer(roomID, playerID, name string, ban bool) error {
+	b := model.Ban{PlayerID: playerID, Name: name, Kick: !ban, Created: time.Now().UnixMilli()}
+	var err error
+	if ban {
+		if b.IP, err = s.store.PlayerIP(roomID, playerID); err != nil {
+			return err
+		}
+	}
+	if b.ID, err = newBanID(); err != nil {
+		return err
+	}
+	err = s.store.AddBan(roomID, b)
+	s.bans.forget(roomID)
+	if err != nil {
+		return err
+	}
+	ev, err := newKickEvent(roomID, playerID, ban)
+	if err != nil {
+		log.Printf("moderation: encode kick: %v", err)
+		return nil
+	}
+	s.broadcaster.Send(roomID, ev)
+	return nil
+}
+
+// moderate handles the GM's kick, ban and unban actions.
+func (s *Server) moderate(w http.ResponseWriter, r *http.Request, roomID string, viewer model.Viewer) {
+	if !viewer.GM {
+		http.Error(w, "Only the GM can moderate the room", http.StatusForbidden)
+		return
+	}
+	switch action := r.FormValue("action"); action {
+	case "unban":
+		err := s.store.LiftBan(roomID, r.FormValue("banId"))
+		s.bans.forget(roomID)
+		if err != nil {
+			if errors.Is(err, store.ErrBanNotFound) {
+				http.Error(w, "Ban not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Could not lift ban", http.StatusInternalServerError)
+			}
+			return
+		}
+	default:
+		playerID := r.FormValue("playerId")
+		if playerID == "" {
+			http.Error(w, "Invalid player", http.StatusBadRequest)
+			return
+		}
+		if playerID == viewer.PlayerID {
+			http.Error(w, "The GM can not remove themselves", http.StatusBadRequest)
+			return
+		}
+		if err := s.removePlayer(roomID, playerID, cleanName(r.FormValue("name")), action == "ban"); err != nil {
+			http.Error(w, "Could not remove player", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, s.prefixFor(r)+"/room/"+roomID, http.StatusSeeOther)
+}
+
+// members lists who the GM may remove from the room: the players present,
+// then anyone else among the recent rolls. Players already removed and the
+// GM themselves are left out.
+func members(present []model.Player, recent []model.LogEntry, bans []model.Ban, gm model.Viewer) []model.Player {
+	skip := map[string]bool{"": true, gm.PlayerID: true}
+	for _, ban := range bans {
+		skip[ban.PlayerID] = true
+	}
+	list := make([]model.Player, 0, len(present))
+	for _, p := range present {
+		if !skip[p.ID] {
+			list = append(list, p)
+			skip[p.ID] = true
+		}
+	}
+	var rollers []model.Player
+	for _, e := range recent {
+		if !skip[e.PlayerID] {
+			rollers = append(rollers, model.Player{ID: e.PlayerID, Name: e.User})
+			skip[e.PlayerID] = true
+		}
+	}
+	slices.SortFunc(rollers, func(a, b model.Player) int { return cmp.Compare(a.Name, b.Name) })
+	return append(list, rollers...)
+}
+
+// activeBans leaves out the kicks, which the GM has nothing to undo about.
+func activeBans(bans []model.Ban) []model.Ban {
+	var active []model.Ban
+	for _, ban := range bans {
+		if !ban.Kick {
+			active = append(active, ban)
+		}
+	}
+	return active
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"dice_room/dice"
+	"dice_room/model"
+	"dice_room/store"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBarred(t *testing.T) {
+	bans := []model.Ban{
+		{ID: "b1", PlayerID: "p-kicked", Kick: true},
+		{ID: "b2", PlayerID: "p-banned", IP: "203.0.113.7"},
+	}
+	for name, tc := range map[string]struct {
+		viewer         model.Viewer
+		ip             string
+		banned, kicked bool
+	}{
+		"stranger":            {model.Viewer{PlayerID: "p-other"}, "198.51.100.1", false, false},
+		"not joined":          {model.Viewer{}, "198.51.100.1", false, false},
+		"kicked":              {model.Viewer{PlayerID: "p-kicked"}, "198.51.100.1", false, true},
+		"banned":              {model.Viewer{PlayerID: "p-banned"}, "198.51.100.1", true, false},
+		"new name, same ip":   {model.Viewer{PlayerID: "p-new"}, "203.0.113.7", true, false},
+		"not joined, same ip": {model.Viewer{}, "203.0.113.7", true, false},
+		"gm at a banned ip":   {model.Viewer{PlayerID: "p-banned", GM: true}, "203.0.113.7", false, false},
+	} {
+		banned, kicked := barred(bans, tc.viewer, tc.ip)
+		if banned != tc.banned || kicked != tc.kicked {
+			t.Errorf("%s: barred = %v, %v, want %v, %v", name, banned, kicked, tc.banned, tc.kicked)
+		}
+	}
+}
+
+func TestBanCoversTheAddressSeenOnAnotherInstance(t *testing.T) {
+	st := store.NewMemoryStore()
+	// a serves ann's stream; the GM bans her on b.
+	a, b := testServer(st), testServer(st)
+	room, err := st.CreateRoom("r", dice.NewServerSeed(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann := model.Viewer{PlayerID: "p1", Name: "ann"}
+	a.openStream(room.Id, ann, "203.0.113.7")()
+
+	newcomer := httptest.NewRequest("GET", "/room/"+room.Id, nil)
+	newcomer.RemoteAddr = "203.0.113.7:4000"
+	if _, ok, err := b.admit(newcomer, room); err != nil || !ok {
+		t.Fatalf("before the ban: admitted %v, %v", ok, err)
+	}
+	if err := b.removePlayer(room.Id, ann.PlayerID, ann.Name, true); err != nil {
+		t.Fatal(err)
+	}
+	bans, _ := st.Bans(room.Id)
+	if len(bans) != 1 || bans[0].IP != "203.0.113.7" {
+		t.Fatalf("bans = %+v, want ann's address banned", bans)
+	}
+	// b cached the room's bans before making this one, and must not use them.
+	if _, ok, _ := b.admit(newcomer, room); ok {
+		t.Error("a newcomer at the banned address was let in")
+	}
+}
+
+func TestExpiredKicksAreLifted(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := testServer(st)
+	room, err := st.CreateRoom("r", dice.NewServerSeed(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := model.Ban{ID: "old", PlayerID: "p1", Kick: true, Created: now.Add(-kickTTL - time.Hour).UnixMilli()}
+	recent := model.Ban{ID: "recent", PlayerID: "p2", Kick: true, Created: now.UnixMilli()}
+	ban := model.Ban{ID: "ban", PlayerID: "p3", Created: now.Add(-kickTTL - time.Hour).UnixMilli()}
+	for _, b := range []model.Ban{old, recent, ban} {
+		if err := st.AddBan(room.Id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bans, err := s.roomBans(room.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := st.Bans(room.Id)
+	for name, got := range map[string][]model.Ban{"in force": bans, "stored": stored} {
+		ids := make(map[string]bool)
+		for _, b := range got {
+			ids[b.ID] = true
+		}
+		if len(got) != 2 || !ids["recent"] || !ids["ban"] {
+			t.Errorf("%s bans = %+v, want the recent kick and the old ban", name, got)
+		}
+	}
+}
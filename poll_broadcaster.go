@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = 2 * time.Second
+	// outboxPage is how many outbox events a poll reads at a time.
+	outboxPage = 100
+	// outboxQueue is how many sent events may wait to be appended to the
+	// outbox before Send waits for the store.
+	outboxQueue = 256
+)
+
+// PollingBroadcaster shares live events between instances that use the same
+// store, so players connected to different replicas see each other's rolls,
+// reveals, chat and comings and goings, and a kick or ban ends the player's
+// streams wherever they are served. Events sent here reach local streams at
+// once and are appended to the room's outbox in the store, in the order they
+// were sent, by a writer of their own; events appended by other instances are
+// found by polling the outbox of each room that has subscribers here.
+type PollingBroadcaster struct {
+	*LocalBroadcaster
+	store    store.Store
+	interval time.Duration
+	// origin tells the events this instance appends from everyone else's.
+	origin string
+
+	mu sync.Mutex
+	// rooms holds the id of the last outbox event read in each polled room.
+	rooms map[string]int64
+	// remote, if set, rewrites events from other instances before delivery.
+	remote func(roomID, origin string, ev Event) Event
+
+	// outbox queues sent events for the writer to append.
+	outbox chan queuedEvent
+
+	stop    chan struct{}
+	done    chan struct{}
+	written chan struct{}
+	once    sync.Once
+}
+
+// queuedEvent is a sent event waiting to be appended to a room's outbox.
+type queuedEvent struct {
+	roomID  string
+	payload string
+}
+
+// outboxEvent is an Event as it is shared through a room's outbox.
+type outboxEvent struct {
+	Origin   string        `json:"origin"`
+	ID       int64         `json:"id,omitempty"`
+	Data     string        `json:"data"`
+	Redacted string        `json:"redacted,omitempty"`
+	Audience audience      `json:"audience"`
+	Final    bool          `json:"final,omitempty"`
+	Roster   *rosterUpdate `json:"roster,omitempty"`
+}
+
+// NewPollingBroadcaster delivers through local and polls st every interval
+// until Close.
+func NewPollingBroadcaster(local *LocalBroadcaster, st store.Store, interval time.Duration) *PollingBroadcaster {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	p := &PollingBroadcaster{
+		LocalBroadcaster: local,
+		store:            st,
+		interval:         interval,
+		origin:           newInstanceID(),
+		rooms:            make(map[string]int64),
+		outbox:           make(chan queuedEvent, outboxQueue),
+		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
+		written:          make(chan struct{}),
+	}
+	go p.run()
+	go p.write()
+	return p
+}
+
+// newInstanceID returns a random id that tells this instance from the others
+// sharing its store.
+func newInstanceID() string {
+	return rand.Text()
+}
+
+// OnRemote sets f to rewrite each event another instance sent before it is
+// delivered here.
+func (p *PollingBroadcaster) OnRemote(f func(roomID, origin string, ev Event) Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remote = f
+}
+
+// Subscribe also starts polling the room, from its newest outbox event, if it
+// is not polled already. The stream's own replay covers the rolls before that.
+func (p *PollingBroadcaster) Subscribe(roomID string, viewer model.Viewer) (*Subscriber, error) {
+	sub, err := p.LocalBroadcaster.Subscribe(roomID, viewer)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.track(roomID); err != nil {
+		// The next poll tries again.
+		log.Printf("broadcast: start polling room %s: %v", roomID, err)
+	}
+	return sub, nil
+}
+
+// track starts polling a room from its newest outbox event.
+func (p *PollingBroadcaster) track(roomID string) error {
+	p.mu.Lock()
+	_, ok := p.rooms[roomID]
+	p.mu.Unlock()
+	if ok {
+		return nil
+	}
+	last, err := p.store.LastEventID(roomID)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.rooms[roomID]; !ok {
+		p.rooms[roomID] = last
+	}
+	return nil
+}
+
+// Send delivers ev to local streams and queues it to be appended to the room's
+// outbox for the other instances, so the request that sent it does not wait
+// on the store unless the queue is full. An event that cannot be appended
+// still reaches the streams here.
+func (p *PollingBroadcaster) Send(roomID string, ev Event) {
+	p.LocalBroadcaster.Send(roomID, ev)
+	payload, err := json.Marshal(outboxEvent{
+		Origin:   p.origin,
+		ID:       ev.ID,
+		Data:     ev.Data,
+		Redacted: ev.Redacted,
+		Audience: ev.audience,
+		Final:    ev.final,
+		Roster:   ev.roster,
+	})
+	if err != nil {
+		log.Printf("broadcast: share event in room %s: %v", roomID, err)
+		return
+	}
+	select {
+	case p.outbox <- queuedEvent{roomID: roomID, payload: string(payload)}:
+	case <-p.stop:
+		log.Printf("broadcast: share event in room %s: broadcaster closed", roomID)
+	}
+}
+
+// Close stops polling, appends the events already queued and ends every local
+// subscription.
+func (p *PollingBroadcaster) Close() {
+	p.once.Do(func() {
+		close(p.stop)
+		<-p.done
+		<-p.written
+	})
+	p.LocalBroadcaster.Close()
+}
+
+// write appends queued events to their rooms' outboxes until Close, then
+// appends whatever is still queued.
+func (p *PollingBroadcaster) write() {
+	defer close(p.written)
+	for {
+		select {
+		case q := <-p.outbox:
+			p.append(q)
+		case <-p.stop:
+			for {
+				select {
+				case q := <-p.outbox:
+					p.append(q)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *PollingBroadcaster) append(q queuedEvent) {
+	if _, err := p.store.AppendEvent(q.roomID, q.payload); err != nil {
+		log.Printf("broadcast: share event in room %s: %v", q.roomID, err)
+	}
+}
+
+func (p *PollingBroadcaster) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.poll()
+		}
+	}
+}
+
+// poll delivers the events other instances sent since the last poll in every
+// room with local subscribers, and forgets rooms that no longer have any.
+func (p *PollingBroadcaster) poll() {
+	for _, roomID := range p.LocalBroadcaster.rooms() {
+		if err := p.pollRoom(roomID); err != nil {
+			log.Printf("broadcast: poll room %s: %v", roomID, err)
+		}
+	}
+	// Subscribe registers locally before it tracks a room, so a room tracked
+	// while this runs already shows as having subscribers.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for roomID := range p.rooms {
+		if !p.LocalBroadcaster.hasSubscribers(roomID) {
+			delete(p.rooms, roomID)
+		}
+	}
+}
+
+func (p *PollingBroadcaster) pollRoom(roomID string) error {
+	p.mu.Lock()
+	after, ok := p.rooms[roomID]
+	remote := p.remote
+	p.mu.Unlock()
+
+	if !ok {
+		// Subscribe could not start polling it; start from here.
+		return p.track(roomID)
+	}
+
+	for {
+		events, err := p.store.EventsAfter(roomID, after, outboxPage)
+		if err != nil {
+			return err
+		}
+		for _, stored := range events {
+			after = stored.ID
+			var shared outboxEvent
+			if err := json.Unmarshal([]byte(stored.Payload), &shared); err != nil {
+				log.Printf("broadcast: decode event %d in room %s: %v", stored.ID, roomID, err)
+				continue
+			}
+			if shared.Origin == p.origin {
+				continue
+			}
+			ev := Event{
+				ID:       shared.ID,
+				Data:     shared.Data,
+				Redacted: shared.Redacted,
+				audience: shared.Audience,
+				final:    shared.Final,
+				roster:   shared.Roster,
+			}
+			if remote != nil {
+				ev = remote(roomID, shared.Origin, ev)
+			}
+			p.LocalBroadcaster.Send(roomID, ev)
+		}
+
+		p.mu.Lock()
+		if _, ok := p.rooms[roomID]; ok {
+			p.rooms[roomID] = after
+		}
+		p.mu.Unlock()
+		if len(events) < outboxPage {
+			return nil
+		}
+	}
+}
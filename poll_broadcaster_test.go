@@ -0,0 +1,291 @@
+package main
+
+import (
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordRoll stores a roll the way rollDice does and sends it on b, as the
+// instance that served the roll would.
+func recordRoll(t *testing.T, st store.Store, b Broadcaster, roomID, user string) int64 {
+	t.Helper()
+	entry := model.LogEntry{User: user, Dice: "d6", Result: 3}
+	if err := st.AddEntry(roomID, &entry); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := newRollEvent(roomID, &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Send(roomID, ev)
+	return entry.Seq
+}
+
+func expectEvent(t *testing.T, sub *Subscriber, id int64, who string) {
+	t.Helper()
+	select {
+	case ev := <-sub.Events():
+		if ev.ID != id {
+			t.Errorf("%s got event %d, want %d", who, ev.ID, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s never got event %d", who, id)
+	}
+}
+
+// nextEvent returns the next event sub is sent, decoded.
+func nextEvent(t *testing.T, sub *Subscriber, who string) (Event, model.RoomEvent) {
+	t.Helper()
+	select {
+	case ev := <-sub.Events():
+		var decoded model.RoomEvent
+		if err := json.Unmarshal([]byte(ev.Data), &decoded); err != nil {
+			t.Fatalf("%s got undecodable event %q: %v", who, ev.Data, err)
+		}
+		return ev, decoded
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s never got an event", who)
+	}
+	return Event{}, model.RoomEvent{}
+}
+
+func expectNoEvent(t *testing.T, sub *Subscriber, who string) {
+	t.Helper()
+	select {
+	case ev := <-sub.Events():
+		t.Errorf("%s got unexpected event %d", who, ev.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Two instances sharing a store stand in for two replicas behind the gateway.
+func TestPollingBroadcasterSharesRollsBetweenInstances(t *testing.T) {
+	st := store.NewMemoryStore()
+	room, err := st.CreateRoom("table", model.ServerSeed{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rolls from before anyone subscribed are left to the streams' own replay.
+	recordRoll(t, st, NewLocalBroadcaster(StreamConfig{}), room.Id, "carol")
+
+	a := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer a.Close()
+	b := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer b.Close()
+	onA, onB := subscribe(t, a, room.Id, model.Viewer{}), subscribe(t, b, room.Id, model.Viewer{})
+
+	// Each roll reaches both instances' subscribers exactly once.
+	fromA := recordRoll(t, st, a, room.Id, "alice")
+	expectEvent(t, onA, fromA, "subscriber on a")
+	expectEvent(t, onB, fromA, "subscriber on b")
+
+	fromB := recordRoll(t, st, b, room.Id, "bob")
+	expectEvent(t, onB, fromB, "subscriber on b")
+	expectEvent(t, onA, fromB, "subscriber on a")
+
+	expectNoEvent(t, onA, "subscriber on a")
+	expectNoEvent(t, onB, "subscriber on b")
+}
+
+func TestPollingBroadcasterSharesRevealsAndKicks(t *testing.T) {
+	st := store.NewMemoryStore()
+	room, err := st.CreateRoom("table", model.ServerSeed{}, "gm", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer a.Close()
+	b := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer b.Close()
+	target := subscribe(t, b, room.Id, model.Viewer{PlayerID: "p1", Name: "ann"})
+	bystander := subscribe(t, b, room.Id, model.Viewer{PlayerID: "p2", Name: "bob"})
+
+	// The GM, on a, reveals a secret roll.
+	entry := model.LogEntry{User: "gm", Dice: "d20", Result: 17, Visibility: model.VisibilityGM}
+	if err := st.AddEntry(room.Id, &entry); err != nil {
+		t.Fatal(err)
+	}
+	revealed, _ := st.RevealRoll(room.Id, entry.Seq)
+	reveal, err := newEvent(model.RoomEvent{Type: model.EventReveal, RoomID: room.Id, Payload: revealed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Send(room.Id, reveal)
+	for who, sub := range map[string]*Subscriber{"target": target, "bystander": bystander} {
+		ev, decoded := nextEvent(t, sub, who)
+		if _, ok := ev.For(sub.Viewer()); !ok || decoded.Type != model.EventReveal {
+			t.Errorf("%s got %s event, visible %v, want the reveal", who, decoded.Type, ok)
+		}
+	}
+
+	// Then bans ann, whose streams are all on b.
+	kick, err := newKickEvent(room.Id, "p1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Send(room.Id, kick)
+	ev, decoded := nextEvent(t, target, "target")
+	out, ok := ev.For(target.Viewer())
+	if !ok || !out.final || decoded.Type != model.EventKick {
+		t.Errorf("target got %s event, visible %v, final %v, want a final kick", decoded.Type, ok, out.final)
+	}
+	ev, _ = nextEvent(t, bystander, "bystander")
+	if _, ok := ev.For(bystander.Viewer()); ok {
+		t.Error("the kick reached a bystander")
+	}
+	expectNoEvent(t, target, "target")
+	expectNoEvent(t, bystander, "bystander")
+}
+
+func TestPresenceListsPlayersOnOtherInstances(t *testing.T) {
+	st := store.NewMemoryStore()
+	room, err := st.CreateRoom("table", model.ServerSeed{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer a.Close()
+	b := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer b.Close()
+	onA, onB := NewPresence(a, time.Millisecond), NewPresence(b, time.Millisecond)
+	onA.Share(a)
+	onB.Share(b)
+	watcher := subscribe(t, b, room.Id, model.Viewer{})
+
+	onB.Join(room.Id, model.Player{ID: "p2", Name: "bob"})
+	nextEvent(t, watcher, "watcher")
+	leave := onA.Join(room.Id, model.Player{ID: "p1", Name: "ann"})
+	_, joined := nextEvent(t, watcher, "watcher")
+	var payload model.PresencePayload
+	if b, _ := json.Marshal(joined.Payload); json.Unmarshal(b, &payload) != nil || payload.User != "ann" {
+		t.Fatalf("event on b = %+v, want ann joining", joined)
+	}
+	if want := []string{"ann", "bob"}; !reflect.DeepEqual(payload.Players, want) || !reflect.DeepEqual(onB.Players(room.Id), want) {
+		t.Errorf("players on b = %v in the event, %v listed, want %v", payload.Players, onB.Players(room.Id), want)
+	}
+
+	leave()
+	_, left := nextEvent(t, watcher, "watcher")
+	if left.Type != model.EventLeave || !reflect.DeepEqual(onB.Players(room.Id), []string{"bob"}) {
+		t.Errorf("after ann left: %s event, players on b %v", left.Type, onB.Players(room.Id))
+	}
+}
+
+func TestPresenceOnlyAnnouncesComingsAndGoingsAcrossInstances(t *testing.T) {
+	st := store.NewMemoryStore()
+	room, err := st.CreateRoom("table", model.ServerSeed{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer a.Close()
+	b := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer b.Close()
+	onA, onB := NewPresence(a, time.Millisecond), NewPresence(b, time.Millisecond)
+	onA.Share(a)
+	onB.Share(b)
+	watchA, watchB := subscribe(t, a, room.Id, model.Viewer{}), subscribe(t, b, room.Id, model.Viewer{})
+	expect := func(sub *Subscriber, who, kind string) {
+		t.Helper()
+		if _, ev := nextEvent(t, sub, who); ev.Type != kind {
+			t.Errorf("%s got a %s event, want %s", who, ev.Type, kind)
+		}
+	}
+	ann := model.Player{ID: "p1", Name: "ann"}
+
+	leaveA := onA.Join(room.Id, ann)
+	expect(watchA, "watcher on a", model.EventJoin)
+	expect(watchB, "watcher on b", model.EventJoin)
+
+	// Ann opens a second device on the other instance: she was already here.
+	leaveB := onB.Join(room.Id, ann)
+	expect(watchB, "watcher on b", model.EventPresence)
+	expect(watchA, "watcher on a", model.EventPresence)
+
+	// Closing the first device leaves her present through b.
+	leaveA()
+	expect(watchA, "watcher on a", model.EventPresence)
+	expect(watchB, "watcher on b", model.EventPresence)
+	if want := []string{"ann"}; !reflect.DeepEqual(onA.Players(room.Id), want) || !reflect.DeepEqual(onB.Players(room.Id), want) {
+		t.Errorf("players after one device closed: %v on a, %v on b, want %v", onA.Players(room.Id), onB.Players(room.Id), want)
+	}
+
+	leaveB()
+	expect(watchB, "watcher on b", model.EventLeave)
+	expect(watchA, "watcher on a", model.EventLeave)
+}
+
+func TestPollingBroadcasterStopsPollingEmptyRooms(t *testing.T) {
+	st := store.NewMemoryStore()
+	room, err := st.CreateRoom("table", model.ServerSeed{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), st, 5*time.Millisecond)
+	defer p.Close()
+
+	sub := subscribe(t, p, room.Id, model.Viewer{})
+	p.Unsubscribe(room.Id, sub)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.mu.Lock()
+		n := len(p.rooms)
+		p.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("room is still polled after its last subscriber left")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// slowOutbox is a store whose outbox appends wait until release is closed.
+type slowOutbox struct {
+	store.Store
+	release chan struct{}
+}
+
+func (s slowOutbox) AppendEvent(roomID, payload string) (int64, error) {
+	<-s.release
+	return s.Store.AppendEvent(roomID, payload)
+}
+
+func TestPollingBroadcasterSendsWithoutWaitingForTheStore(t *testing.T) {
+	st := store.NewMemoryStore()
+	room, err := st.CreateRoom("table", model.ServerSeed{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := slowOutbox{Store: st, release: make(chan struct{})}
+	a := NewPollingBroadcaster(NewLocalBroadcaster(StreamConfig{}), slow, time.Hour)
+	onA := subscribe(t, a, room.Id, model.Viewer{})
+
+	ev, err := newRollEvent(room.Id, &model.LogEntry{Seq: 1, User: "alice", Dice: "d6", Result: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan struct{})
+	go func() {
+		a.Send(room.Id, ev)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send waited for the outbox")
+	}
+	expectEvent(t, onA, 1, "subscriber on a")
+
+	// Close appends what is still queued.
+	close(slow.release)
+	a.Close()
+	if events, err := st.EventsAfter(room.Id, 0, 10); err != nil || len(events) != 1 {
+		t.Errorf("outbox after Close = %+v, %v, want the roll", events, err)
+	}
+}
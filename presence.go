@@ -0,0 +1,307 @@
+package main
+
+import (
+	"cmp"
+	"dice_room/model"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPresenceGrace = 15 * time.Second
+	// rosterRefresh is how often an instance shares its players in each room
+	// with the others, and rosterTTL how long the others trust what it shared.
+	rosterRefresh = 30 * time.Second
+	rosterTTL     = 3 * rosterRefresh
+)
+
+// Presence tracks which players have a live stream open in each room and
+// broadcasts join and leave events. A player whose last stream closes is only
+// reported as gone once grace has passed without them reconnecting, so
+// recycled connections and sleeping phones do not flicker the list. It tracks
+// the streams served by this instance, and once shared, lists the players
+// other instances report too.
+type Presence struct {
+	broadcaster Broadcaster
+	grace       time.Duration
+
+	mu sync.Mutex
+	// rooms holds each room's present players by player id.
+	rooms map[string]map[string]*presentPlayer
+	// remote holds the players other instances last reported in each room,
+	// by instance.
+	remote map[string]map[string]remoteRoster
+}
+
+// rosterUpdate travels with a presence event to the other instances: what
+// happened and to whom, and the sending instance's own players in the room
+// afterwards.
+type rosterUpdate struct {
+	Kind     string         `json:"kind"`
+	User     string         `json:"user,omitempty"`
+	PlayerID string         `json:"playerId,omitempty"`
+	Players  []model.Player `json:"players"`
+}
+
+type remoteRoster struct {
+	players []model.Player
+	expires time.Time
+}
+
+type presentPlayer struct {
+	name    string
+	streams int
+	// leaving is the pending leave once the player has no streams left.
+	leaving *time.Timer
+}
+
+func NewPresence(broadcaster Broadcaster, grace time.Duration) *Presence {
+	if grace <= 0 {
+		grace = defaultPresenceGrace
+	}
+	return &Presence{
+		broadcaster: broadcaster,
+		grace:       grace,
+		rooms:       make(map[string]map[string]*presentPlayer),
+		remote:      make(map[string]map[string]remoteRoster),
+	}
+}
+
+// Share lists the players of the instances poller shares events with, and
+// keeps telling them about this instance's until poller is closed.
+func (p *Presence) Share(poller *PollingBroadcaster) {
+	poller.OnRemote(p.remoteEvent)
+	go func() {
+		ticker := time.NewTicker(rosterRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-poller.stop:
+				return
+			case <-ticker.C:
+				p.refresh()
+			}
+		}
+	}()
+}
+
+// refresh announces who is present in every room with players here, which
+// renews this instance's roster on the others before it expires.
+func (p *Presence) refresh() {
+	p.mu.Lock()
+	rooms := make([]string, 0, len(p.rooms))
+	for roomID := range p.rooms {
+		rooms = append(rooms, roomID)
+	}
+	p.mu.Unlock()
+	for _, roomID := range rooms {
+		p.mu.Lock()
+		list, own := p.list(roomID), p.local(roomID)
+		p.mu.Unlock()
+		p.announce(model.EventPresence, roomID, model.Player{}, list, own)
+	}
+}
+
+// remoteEvent records the roster another instance sent with a presence event,
+// and rewrites the event with the room's players as this instance lists them.
+// A join or leave by a player who is also present through another instance is
+// only a relisting here.
+func (p *Presence) remoteEvent(roomID, origin string, ev Event) Event {
+	if ev.roster == nil {
+		return ev
+	}
+	update := *ev.roster
+	p.mu.Lock()
+	before := update.PlayerID != "" && p.present(roomID, update.PlayerID)
+	rosters, ok := p.remote[roomID]
+	if !ok {
+		rosters = make(map[string]remoteRoster)
+		p.remote[roomID] = rosters
+	}
+	if len(update.Players) == 0 {
+		delete(rosters, origin)
+	} else {
+		rosters[origin] = remoteRoster{players: update.Players, expires: time.Now().Add(rosterTTL)}
+	}
+	if len(rosters) == 0 {
+		delete(p.remote, roomID)
+	}
+	after := update.PlayerID != "" && p.present(roomID, update.PlayerID)
+	list := p.list(roomID)
+	p.mu.Unlock()
+
+	kind, user := update.Kind, update.User
+	if (kind == model.EventJoin && before) || (kind == model.EventLeave && after) {
+		kind, user = model.EventPresence, ""
+	}
+	out, err := newEvent(model.RoomEvent{
+		Type:    kind,
+		RoomID:  roomID,
+		Payload: model.PresencePayload{User: user, Players: list},
+	})
+	if err != nil {
+		log.Printf("presence: encode %s: %v", update.Kind, err)
+		return ev
+	}
+	return out
+}
+
+// Join records a stream opened by a player in a room and returns the func to
+// call when that stream closes. Only a player's first stream announces a join,
+// and only if they are not present through another instance already.
+func (p *Presence) Join(roomID string, who model.Player) (leave func()) {
+	p.mu.Lock()
+	elsewhere := p.present(roomID, who.ID)
+	players, ok := p.rooms[roomID]
+	if !ok {
+		players = make(map[string]*presentPlayer)
+		p.rooms[roomID] = players
+	}
+	player, present := players[who.ID]
+	if !present {
+		player = &presentPlayer{}
+		players[who.ID] = player
+	}
+	player.name = who.Name
+	player.streams++
+	if player.leaving != nil {
+		// Back within the grace period: nobody saw them go.
+		player.leaving.Stop()
+		player.leaving = nil
+	}
+	list, own := p.list(roomID), p.local(roomID)
+	p.mu.Unlock()
+
+	switch {
+	case !present && elsewhere:
+		// The others still learn that this instance has them too.
+		p.announce(model.EventPresence, roomID, model.Player{}, list, own)
+	case !present:
+		p.announce(model.EventJoin, roomID, who, list, own)
+	}
+	var once sync.Once
+	return func() { once.Do(func() { p.closeStream(roomID, who.ID, player) }) }
+}
+
+func (p *Presence) closeStream(roomID, id string, player *presentPlayer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	player.streams--
+	if player.streams > 0 {
+		return
+	}
+	player.leaving = time.AfterFunc(p.grace, func() { p.expire(roomID, id, player) })
+}
+
+// expire removes a player whose grace period ran out.
+func (p *Presence) expire(roomID, id string, player *presentPlayer) {
+	p.mu.Lock()
+	players := p.rooms[roomID]
+	// They may have come back, or been replaced, since the timer was set.
+	if players[id] != player || player.streams > 0 {
+		p.mu.Unlock()
+		return
+	}
+	delete(players, id)
+	if len(players) == 0 {
+		delete(p.rooms, roomID)
+	}
+	elsewhere := p.present(roomID, id)
+	list, own := p.list(roomID), p.local(roomID)
+	p.mu.Unlock()
+
+	if elsewhere {
+		p.announce(model.EventPresence, roomID, model.Player{}, list, own)
+		return
+	}
+	p.announce(model.EventLeave, roomID, model.Player{ID: id, Name: player.name}, list, own)
+}
+
+// Players lists the players present in a room, sorted by name.
+func (p *Presence) Players(roomID string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.list(roomID)
+}
+
+// list is Players for callers that hold mu.
+func (p *Presence) list(roomID string) []string {
+	members := p.members(roomID)
+	names := make([]string, len(members))
+	for i, member := range members {
+		names[i] = member.Name
+	}
+	return names
+}
+
+// Members lists the players present in a room with their ids, sorted by name.
+func (p *Presence) Members(roomID string) []model.Player {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.members(roomID)
+}
+
+// present reports whether a player is in the room, here or through another
+// instance. The caller holds mu.
+func (p *Presence) present(roomID, id string) bool {
+	return slices.ContainsFunc(p.members(roomID), func(member model.Player) bool {
+		return member.ID == id
+	})
+}
+
+// local lists the players with streams on this instance. The caller holds mu.
+func (p *Presence) local(roomID string) []model.Player {
+	players := make([]model.Player, 0, len(p.rooms[roomID]))
+	for id, player := range p.rooms[roomID] {
+		players = append(players, model.Player{ID: id, Name: player.name, Present: true})
+	}
+	return players
+}
+
+// members is Members for callers that hold mu. It merges the players here
+// with those other instances reported, dropping rosters that have expired.
+func (p *Presence) members(roomID string) []model.Player {
+	members := p.local(roomID)
+	seen := make(map[string]bool, len(members))
+	for _, member := range members {
+		seen[member.ID] = true
+	}
+	now := time.Now()
+	for origin, roster := range p.remote[roomID] {
+		if now.After(roster.expires) {
+			delete(p.remote[roomID], origin)
+			continue
+		}
+		for _, player := range roster.players {
+			if !seen[player.ID] {
+				seen[player.ID] = true
+				members = append(members, player)
+			}
+		}
+	}
+	if len(p.remote[roomID]) == 0 {
+		delete(p.remote, roomID)
+	}
+	slices.SortFunc(members, func(a, b model.Player) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+	})
+	return members
+}
+
+// announce tells the room who came or went, if anyone, and who is present, and
+// sends own, the players here, along for the other instances.
+func (p *Presence) announce(kind, roomID string, who model.Player, players []string, own []model.Player) {
+	ev, err := newEvent(model.RoomEvent{
+		Type:    kind,
+		RoomID:  roomID,
+		Payload: model.PresencePayload{User: who.Name, Players: players},
+	})
+	if err != nil {
+		log.Printf("presence: encode %s: %v", kind, err)
+		return
+	}
+	ev.roster = &rosterUpdate{Kind: kind, User: who.Name, PlayerID: who.ID, Players: own}
+	p.broadcaster.Send(roomID, ev)
+}
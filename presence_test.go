@@ -0,0 +1,70 @@
+package main
+
+import (
+	"dice_room/model"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// expectPresence waits for a join or leave event on sub and checks it.
+func expectPresence(t *testing.T, sub *Subscriber, kind, user string, players ...string) {
+	t.Helper()
+	select {
+	case ev := <-sub.Events():
+		var got struct {
+			Type    string
+			Payload model.PresencePayload
+		}
+		if err := json.Unmarshal([]byte(ev.Data), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != kind || got.Payload.User != user || !slices.Equal(got.Payload.Players, players) {
+			t.Errorf("got %s of %q with %v, want %s of %q with %v",
+				got.Type, got.Payload.User, got.Payload.Players, kind, user, players)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no %s event for %q", kind, user)
+	}
+}
+
+func TestPresenceAnnouncesFirstJoinAndLastLeave(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{})
+	p := NewPresence(b, 10*time.Millisecond)
+	watcher := subscribe(t, b, "r", model.Viewer{})
+
+	leaveFirst := p.Join("r", model.Player{ID: "p-bob", Name: "bob"})
+	expectPresence(t, watcher, model.EventJoin, "bob", "bob")
+	leaveSecond := p.Join("r", model.Player{ID: "p-bob", Name: "bob"})
+	p.Join("r", model.Player{ID: "p-alice", Name: "alice"})
+	expectPresence(t, watcher, model.EventJoin, "alice", "alice", "bob")
+
+	// Bob still has a stream open, so closing one says nothing.
+	leaveFirst()
+	leaveFirst()
+	time.Sleep(30 * time.Millisecond)
+	expectNoEvent(t, watcher, "watcher")
+
+	leaveSecond()
+	expectPresence(t, watcher, model.EventLeave, "bob", "alice")
+	if got := p.Players("r"); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("players = %v, want [alice]", got)
+	}
+}
+
+func TestPresenceReconnectWithinGraceIsSilent(t *testing.T) {
+	b := NewLocalBroadcaster(StreamConfig{})
+	p := NewPresence(b, 50*time.Millisecond)
+	watcher := subscribe(t, b, "r", model.Viewer{})
+
+	leave := p.Join("r", model.Player{ID: "p-bob", Name: "bob"})
+	expectPresence(t, watcher, model.EventJoin, "bob", "bob")
+	leave()
+	leave = p.Join("r", model.Player{ID: "p-bob", Name: "bob"})
+	time.Sleep(100 * time.Millisecond)
+	expectNoEvent(t, watcher, "watcher")
+
+	leave()
+	expectPresence(t, watcher, model.EventLeave, "bob")
+}
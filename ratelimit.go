@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepEvery is how often a RateLimiter forgets the keys that have a full bucket.
+	sweepEvery = time.Minute
+	// roomFullRetry is when to try again after a room had no room for another stream.
+	roomFullRetry = 30 * time.Second
+)
+
+// Rate is a token bucket's size and refill: Events may happen at once, and
+// Events more become allowed every Per. A zero Rate allows everything.
+type Rate struct {
+	Events int
+	Per    time.Duration
+}
+
+func (r Rate) String() string {
+	if r.Events == 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", r.Events, r.Per)
+}
+
+// ParseRate reads a Rate written as "events/duration", such as "30/1m", or "off".
+func ParseRate(s string) (Rate, error) {
+	if s == "off" {
+		return Rate{}, nil
+	}
+	events, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("rate %q is not events/duration", s)
+	}
+	n, err := strconv.Atoi(events)
+	if err != nil || n < 1 {
+		return Rate{}, fmt.Errorf("rate %q needs a positive number of events", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("rate %q needs a positive duration", s)
+	}
+	return Rate{Events: n, Per: d}, nil
+}
+
+// RateLimiter is a token bucket per key, such as a client IP or a room.
+type RateLimiter struct {
+	rate Rate
+	now  func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func NewRateLimiter(rate Rate) *RateLimiter {
+	return &RateLimiter{rate: rate, now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// refill tops b up for the time since it was last used.
+func (l *RateLimiter) refill(b *bucket, now time.Time) {
+	perToken := l.rate.Per.Seconds() / float64(l.rate.Events)
+	b.tokens = math.Min(float64(l.rate.Events), b.tokens+now.Sub(b.at).Seconds()/perToken)
+	b.at = now
+}
+
+// off reports whether l lets everything through.
+func (l *RateLimiter) off() bool {
+	return l == nil || l.rate.Events == 0
+}
+
+// Allow takes a token from key's bucket. If there is none it returns false
+// and how long until there will be.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.off() {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok, wait := l.available(key)
+	if !ok {
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// available returns key's bucket, topped up, and whether it has a token. If
+// it has none, it also returns how long until it will. The caller holds mu.
+func (l *RateLimiter) available(key string) (*bucket, bool, time.Duration) {
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepEvery {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Events), at: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		return b, true, 0
+	}
+	perToken := l.rate.Per.Seconds() / float64(l.rate.Events)
+	return b, false, time.Duration((1 - b.tokens) * perToken * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled, which a new bucket would match.
+// The caller holds mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.rate.Events) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// LimitConfig sets the abuse limits. Zero Rates are off.
+type LimitConfig struct {
+	// CreateRoom limits the rooms each client may create.
+	CreateRoom Rate
+	// Roll limits each client's rolls, across rooms.
+	Roll Rate
+	// RoomRoll limits the rolls in each room, across clients.
+	RoomRoll Rate
+	// Unlock limits each client's passphrase guesses.
+	Unlock Rate
+	// TrustedProxies are the proxies whose X-Forwarded-For is believed.
+	TrustedProxies []netip.Prefix
+}
+
+// Limits holds the rate limiters the handlers share.
+type Limits struct {
+	createRoom *RateLimiter
+	roll       *RateLimiter
+	roomRoll   *RateLimiter
+	unlock     *RateLimiter
+	proxies    []netip.Prefix
+}
+
+func NewLimits(config LimitConfig) *Limits {
+	return &Limits{
+		createRoom: NewRateLimiter(config.CreateRoom),
+		roll:       NewRateLimiter(config.Roll),
+		roomRoll:   NewRateLimiter(config.RoomRoll),
+		unlock:     NewRateLimiter(config.Unlock),
+		proxies:    config.TrustedProxies,
+	}
+}
+
+// ParseProxies reads a comma separated list of IPs and CIDR prefixes.
+func ParseProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (l *Limits) trusted(addr netip.Addr) bool {
+	for _, p := range l.proxies {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address a request came from. X-Forwarded-For is only
+// believed as far back as it was added by trusted proxies: the nearest hop
+// that is not one of them is the client, as anything before it could have
+// been made up by the client itself. A hop that is not an address is the
+// client as far as the proxies can tell, so it is returned as it is: the proxy's
+// own address would put every client behind it in one bucket.
+func (l *Limits) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+	if !l.trusted(addr) {
+		return addr.String()
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		return addr.String()
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		raw := strings.TrimSpace(hops[i])
+		hop, err := netip.ParseAddr(raw)
+		if err != nil {
+			if raw == "" {
+				return strings.Join(forwarded, ",")
+			}
+			return raw
+		}
+		addr = hop.Unmap()
+		if !l.trusted(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// allowRoll takes a token for a roll by client in the room from both limits,
+// or from neither if either has none, so a refused roll costs nothing.
+func (l *Limits) allowRoll(client, roomID string) (bool, time.Duration) {
+	if l.roll.off() {
+		return l.roomRoll.Allow(roomID)
+	}
+	if l.roomRoll.off() {
+		return l.roll.Allow(client)
+	}
+	// Only here are both locked, always in this order.
+	l.roll.mu.Lock()
+	defer l.roll.mu.Unlock()
+	l.roomRoll.mu.Lock()
+	defer l.roomRoll.mu.Unlock()
+	mine, myOK, myWait := l.roll.available(client)
+	room, roomOK, roomWait := l.roomRoll.available(roomID)
+	if !myOK || !roomOK {
+		return false, max(myWait, roomWait)
+	}
+	mine.tokens--
+	room.tokens--
+	return true, 0
+}
+
+// retryAfter is the Retry-After header value for wait, in whole seconds.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(max(wait, time.Second).Seconds())))
+}
+
+// tooManyRequests answers a page, form or stream request that hit a limit.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfter(wait))
+	http.Error(w, "Too many requests. Try again in a moment.", http.StatusTooManyRequests)
+}
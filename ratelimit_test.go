@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(Rate{Events: 2, Per: time.Minute})
+	l.now = func() time.Time { return now }
+
+	for i := range 2 {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("event %d refused within the burst", i+1)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != 30*time.Second {
+		t.Fatalf("third event: ok = %v, wait = %s; want refused for 30s", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another key shares the bucket")
+	}
+
+	now = now.Add(30 * time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("no token after waiting")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("more than one token after waiting for one")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for in, want := range map[string]Rate{
+		"30/1m": {Events: 30, Per: time.Minute},
+		"off":   {},
+	} {
+		got, err := ParseRate(in)
+		if err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "30", "0/1m", "x/1m", "30/0s", "30/soon"} {
+		if _, err := ParseRate(in); err == nil {
+			t.Errorf("ParseRate(%q) succeeded", in)
+		}
+	}
+}
+
+func TestClientIPOnlyBelievesTrustedProxies(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimits(LimitConfig{TrustedProxies: proxies})
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.9:1234", "", "203.0.113.9"},
+		// Untrusted peers can not pick their own address.
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.2:80", "198.51.100.1", "198.51.100.1"},
+		{"[::1]:80", "198.51.100.1, 10.1.2.3", "198.51.100.1"},
+		// Only the hops added by trusted proxies count; the rest is the client's say.
+		{"10.0.0.2:80", "192.0.2.66, 198.51.100.1", "198.51.100.1"},
+		// A trusted proxy speaking for itself is the client.
+		{"10.0.0.2:80", "", "10.0.0.2"},
+		// A hop that is not an address stands for the client, never the proxy.
+		{"10.0.0.2:80", "not an ip", "not an ip"},
+		{"10.0.0.2:80", "198.51.100.1, unknown, 10.1.2.3", "unknown"},
+		{"10.0.0.2:80", "198.51.100.1, , 10.1.2.3", "198.51.100.1, , 10.1.2.3"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := l.clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestRefusedRollsSpendNoToken(t *testing.T) {
+	l := NewLimits(LimitConfig{
+		Roll:     Rate{Events: 1, Per: time.Hour},
+		RoomRoll: Rate{Events: 1, Per: time.Hour},
+	})
+	if ok, _ := l.allowRoll("ann", "busy"); !ok {
+		t.Fatal("first roll refused")
+	}
+	// The room is out of rolls, so bob's roll there must not cost him his own.
+	if ok, _ := l.allowRoll("bob", "busy"); ok {
+		t.Error("roll in a room out of rolls allowed")
+	}
+	if ok, _ := l.allowRoll("bob", "quiet"); !ok {
+		t.Error("a roll refused by one room's limit spent the player's token")
+	}
+	// Ann is out of rolls, so her roll must not cost the room its own.
+	if ok, wait := l.allowRoll("ann", "calm"); ok || wait <= 0 {
+		t.Errorf("roll by a player out of rolls: ok = %v, wait = %s", ok, wait)
+	}
+	if ok, _ := l.allowRoll("cat", "calm"); !ok {
+		t.Error("a roll refused by the player's limit spent the room's token")
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"dice_room/model"
+	"dice_room/dice"
 	"dice_room/store"
 	"embed"
 	"html/template"
@@ -16,32 +16,41 @@ var content embed.FS
 // Server holds all dependencies and serves as the receiver for HTTP handlers.
 type Server struct {
 	store         store.Store
-	broadcaster   *Broadcaster
+	broadcaster   Broadcaster
+	presence      *Presence
+	bans          *banCache
+	signer        *Signer
+	limits        *Limits
+	roller        dice.Roller
 	templates     *template.Template
 	hostPrefix    string
 	secureCookies bool
+	// fair is set when rolls in rooms with a seed are provably fair. A fair
+	// roll's dice come from the seed rather than the roller, so that is only
+	// done with the crypto roller, and a seeded roller decides every roll.
+	fair bool
 }
 
-func NewServer(store store.Store, broadcaster *Broadcaster, hostPrefix string, secureCookies bool) *Server {
+func NewServer(store store.Store, broadcaster Broadcaster, presence *Presence, signer *Signer, limits *Limits, roller dice.Roller, hostPrefix string, secureCookies bool) *Server {
 	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
 		"safeHTML": func(s string) template.HTML {
 			return template.HTML(s)
 		},
-		"reverse": func(xs []model.LogEntry) []model.LogEntry {
-			out := make([]model.LogEntry, len(xs))
-			for i := range xs {
-				out[i] = xs[len(xs)-1-i]
-			}
-			return out
-		},
 	}).ParseFS(content, "templates/*.html"))
 
+	_, fair := roller.(dice.CryptoRoller)
 	return &Server{
 		store:         store,
 		broadcaster:   broadcaster,
+		presence:      presence,
+		bans:          newBanCache(),
+		signer:        signer,
+		limits:        limits,
+		roller:        roller,
 		templates:     tmpl,
 		hostPrefix:    hostPrefix,
 		secureCookies: secureCookies,
+		fair:          fair,
 	}
 }
 
@@ -60,11 +69,13 @@ func (s *Server) prefixFor(r *http.Request) string {
 func (s *Server) routes() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/static/", http.FileServer(http.FS(content)))
-	mux.HandleFunc("/", s.indexHandler)
-	mux.HandleFunc("/room/", s.roomHandler)
+	mux.HandleFunc("/", s.requireCSRF(s.indexHandler))
+	mux.HandleFunc("/room/", s.requireCSRF(s.roomHandler))
 	mux.HandleFunc("/events/", s.eventsHandler)
+	mux.HandleFunc("GET /ws/{roomID}", s.wsHandler)
 	mux.HandleFunc("/privacy", s.privacyHandler)
 	mux.HandleFunc("/terms", s.termsHandler)
 	mux.HandleFunc("/contact", s.contactHandler)
+	s.apiRoutes(mux)
 	return mux
 }
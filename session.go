@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionCookie holds a player's signed session for a room.
+	sessionCookie = "session"
+	// sessionTTL is how long a session lasts without a visit to the room.
+	sessionTTL = 30 * 24 * time.Hour
+	// maxNameLength caps a player's display name.
+	maxNameLength = 40
+)
+
+// session is who a player is in one room. Player is a random id that stays
+// the same when they change their display Name, so whispers and moderation
+// follow the player rather than whatever they call themselves. It is only
+// ever read from a cookie signed by the server.
+type session struct {
+	Room    string `json:"r"`
+	Player  string `json:"p"`
+	Name    string `json:"n"`
+	Expires int64  `json:"e"`
+}
+
+func newPlayerID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// cleanName trims a display name and cuts it to maxNameLength.
+func cleanName(name string) string {
+	name = strings.TrimSpace(name)
+	if r := []rune(name); len(r) > maxNameLength {
+		name = strings.TrimSpace(string(r[:maxNameLength]))
+	}
+	return name
+}
+
+// session is the request's session in the room. It is false if there is none,
+// or if the cookie is forged, expired or from another room.
+func (s *Server) session(r *http.Request, roomID string) (session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return session{}, false
+	}
+	var sess session
+	if err := s.signer.Verify(cookie.Value, &sess); err != nil {
+		return session{}, false
+	}
+	if sess.Room != roomID || sess.Player == "" || sess.Name == "" || time.Now().Unix() >= sess.Expires {
+		return session{}, false
+	}
+	return sess, true
+}
+
+// setSession signs sess, good for another sessionTTL, into the room's cookies.
+func (s *Server) setSession(w http.ResponseWriter, r *http.Request, sess session) error {
+	sess.Expires = time.Now().Add(sessionTTL).Unix()
+	token, err := s.signer.Sign(sess)
+	if err != nil {
+		return err
+	}
+	s.setRoomCookie(w, r, sess.Room, sessionCookie, token)
+	return nil
+}
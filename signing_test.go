@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignerAcceptsOldKeysAfterRotation(t *testing.T) {
+	type payload struct{ N int }
+	before := NewSigner([]byte("old"))
+	token, err := before.Sign(payload{N: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewSigner([]byte("new"), []byte("old"))
+	var got payload
+	if err := after.Verify(token, &got); err != nil || got.N != 7 {
+		t.Fatalf("old token after rotation: %v, %+v", err, got)
+	}
+	fresh, _ := after.Sign(payload{N: 8})
+	if err := before.Verify(fresh, &got); err == nil {
+		t.Error("token signed with the new key accepted by a signer without it")
+	}
+
+	retired := NewSigner([]byte("new"))
+	if err := retired.Verify(token, &got); err == nil {
+		t.Error("token signed with a retired key accepted")
+	}
+}
+
+func TestSessionRejectsForgedCookies(t *testing.T) {
+	s := &Server{signer: NewSigner([]byte("secret"))}
+	rec := httptest.NewRecorder()
+	if err := s.setSession(rec, httptest.NewRequest("GET", "/room/r1", nil), session{Room: "r1", Player: "p1", Name: "ann"}); err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			token = c.Value
+		}
+	}
+
+	forger := &Server{signer: NewSigner([]byte("guess"))}
+	forged, _ := forger.signer.Sign(session{Room: "r1", Player: "p1", Name: "mallory", Expires: time.Now().Add(time.Hour).Unix()})
+	payload, sig, _ := strings.Cut(token, ".")
+
+	for name, tc := range map[string]struct {
+		room, cookie string
+		ok           bool
+	}{
+		"signed":         {"r1", token, true},
+		"other room":     {"r2", token, false},
+		"wrong key":      {"r1", forged, false},
+		"edited payload": {"r1", payload + "A." + sig, false},
+		"plain name":     {"r1", "ann", false},
+		"missing":        {"r1", "", false},
+	} {
+		req := httptest.NewRequest("GET", "/room/"+tc.room, nil)
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tc.cookie})
+		}
+		sess, ok := s.session(req, tc.room)
+		if ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v", name, ok, tc.ok)
+		}
+		if ok && (sess.Player != "p1" || sess.Name != "ann") {
+			t.Errorf("%s: session = %+v", name, sess)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 #!/bin/bash
 
 # DEV
-# go run . --internalBulletPort 10 --port 1234  --dev
+# go run . --store memory --port 1234  --dev
 
 if [ -z "$1" ]
   then
@@ -1,8 +1,11 @@
 function copyRoomLink() {
-  navigator.clipboard.writeText(window.location.href).then(() => {
-    const btn = document.getElementById("share-btn");
+  const btn = document.getElementById("share-btn");
+  // Rooms with a passphrase give their GM an invite link to share instead.
+  const link = btn.dataset.link ? new URL(btn.dataset.link, window.location.href).href : window.location.href;
+  const label = btn.textContent;
+  navigator.clipboard.writeText(link).then(() => {
     btn.textContent = "Copied!";
-    setTimeout(() => { btn.textContent = "Copy room link"; }, 2000);
+    setTimeout(() => { btn.textContent = label; }, 2000);
   });
 }
 
@@ -43,6 +46,8 @@ const diceColors = {
   d12: "#9c27b0",  // purple
   d100: "#77ff01",  // lime
   d20: "#1db954",  // spotify green
+  "d%": "#faf812",  // yellow
+  dF: "#e91e63",   // pink
 };
 
 function applyLogColors() {
@@ -74,10 +79,125 @@ function applyLogColors() {
     }
   }
 }
-// --- Append a new entry to the log ---
-function appendLogEntry(m, logList) {
+// --- Per-die breakdown, mirrors LogEntry.HasBreakdown and room.html ---
+function hasBreakdown(m) {
+  const groups = m.groups || [];
+  if (groups.length !== 1) {
+    return groups.length > 1;
+  }
+  const g = groups[0];
+  return g.dice.length > 1 || g.total !== m.result || !!g.dice[0].label;
+}
+
+function plural(n, one, many) {
+  return n === 1 ? "1 " + one : n + " " + many;
+}
+
+// Mirrors PoolOutcome.Summary in model/models.go.
+function poolSummary(p) {
+  const parts = [plural(p.successes, "success", "successes")];
+  if (p.failures > 0) {
+    parts.push(plural(p.failures, "botch", "botches"));
+  }
+  if (p.criticalGlitch) {
+    parts.push("critical glitch");
+  } else if (p.glitch) {
+    parts.push("glitch");
+  } else if (p.botch) {
+    parts.push("botched");
+  }
+  return parts.join(", ");
+}
+
+// Mirrors Die.Classes in model/models.go.
+function dieClasses(d) {
+  let classes = "die";
+  if (d.dropped) classes += " dropped";
+  if (d.rerolled) classes += " rerolled";
+  if (d.exploded) classes += " exploded";
+  if (d.rolls && d.rolls.length > 0) classes += " compounded";
+  if (d.unclamped) classes += " clamped";
+  if (d.successes > 0) classes += " success";
+  if (d.successes > 1) classes += " double";
+  if (d.failure) classes += " failure";
+  return classes;
+}
+
+// Mirrors Die.Title in model/models.go.
+function dieTitle(d) {
+  if (d.rolls && d.rolls.length > 0) {
+    return d.rolls.join("+");
+  }
+  if (d.unclamped) {
+    return "rolled " + d.unclamped;
+  }
+  return "";
+}
+
+function renderBreakdown(groups) {
+  const div = document.createElement("div");
+  div.className = "breakdown";
+  groups.forEach(g => {
+    const groupSpan = document.createElement("span");
+    groupSpan.className = "group";
+    groupSpan.appendChild(document.createTextNode(g.notation + " ["));
+    g.dice.forEach((d, i) => {
+      if (i > 0) {
+        groupSpan.appendChild(document.createTextNode(" "));
+      }
+      const dieSpan = document.createElement("span");
+      dieSpan.className = dieClasses(d);
+      const title = dieTitle(d);
+      if (title) {
+        dieSpan.title = title;
+      }
+      dieSpan.textContent = d.label || d.value;
+      groupSpan.appendChild(dieSpan);
+    });
+    groupSpan.appendChild(document.createTextNode("]"));
+    div.appendChild(groupSpan);
+  });
+  return div;
+}
+
+// The GM's button to make a secret or whispered roll public, mirrors room.html.
+function buildRevealForm(seq) {
+  const form = document.createElement("form");
+  form.method = "post";
+  form.action = "";
+  form.className = "reveal-roll";
+  [["csrf", CSRF_TOKEN], ["action", "revealRoll"], ["seq", seq]].forEach(([name, value]) => {
+    const input = document.createElement("input");
+    input.type = "hidden";
+    input.name = name;
+    input.value = value;
+    form.appendChild(input);
+  });
+  const button = document.createElement("button");
+  button.type = "submit";
+  button.textContent = "Reveal";
+  form.appendChild(button);
+  return form;
+}
+
+// --- Build the list item for one entry, mirrors room.html ---
+function buildLogEntry(m) {
   const li = document.createElement("li");
-  li.className = "log-entry new";
+  li.className = m.visibility ? `log-entry ${m.visibility}` : "log-entry";
+  li.dataset.seq = m.seq;
+
+  // Someone else's secret roll: all we may know is that it happened.
+  if (m.hidden) {
+    const metaSpan = document.createElement("span");
+    metaSpan.className = "meta";
+    metaSpan.textContent = "GM rolled a die";
+    const timeSpan = document.createElement("span");
+    timeSpan.className = "time";
+    timeSpan.textContent = m.time;
+    li.appendChild(metaSpan);
+    li.appendChild(timeSpan);
+    return li;
+  }
 
   const descDiv = document.createElement("div");
   descDiv.className = "desc";
@@ -94,7 +214,7 @@ function appendLogEntry(m, logList) {
   const diceSpan = document.createElement("span");
   diceSpan.className = "dice";
   diceSpan.dataset.dice = m.dice;
-  diceSpan.textContent = m.dice;
+  diceSpan.textContent = m.expression || m.dice;
 
   const userSpan = document.createElement("span");
   userSpan.className = "username";
@@ -116,9 +236,41 @@ function appendLogEntry(m, logList) {
   li.appendChild(descDiv);
   li.appendChild(diceSpan);
   li.appendChild(userSpan);
+  if (m.api) {
+    const apiSpan = document.createElement("span");
+    apiSpan.className = "api-roll";
+    apiSpan.title = "Rolled through the API under a name the caller chose";
+    apiSpan.textContent = "API";
+    li.appendChild(apiSpan);
+  }
   li.appendChild(metaSpan);
   li.appendChild(resultSpan);
+  if (m.pool) {
+    const poolSpan = document.createElement("span");
+    poolSpan.className = m.pool.botch || m.pool.glitch ? "pool bad" : "pool";
+    poolSpan.textContent = poolSummary(m.pool);
+    li.appendChild(poolSpan);
+  }
   li.appendChild(timeSpan);
+  if (hasBreakdown(m)) {
+    li.appendChild(renderBreakdown(m.groups));
+  }
+  if (m.visibility) {
+    const visibilitySpan = document.createElement("span");
+    visibilitySpan.className = "visibility";
+    visibilitySpan.textContent = m.visibility === "whisper" ? "whisper" : "secret";
+    li.appendChild(visibilitySpan);
+    if (IS_GM) {
+      li.appendChild(buildRevealForm(m.seq));
+    }
+  }
+  return li;
+}
+
+// --- Append a new entry to the log ---
+function appendLogEntry(m, logList) {
+  const li = buildLogEntry(m);
+  li.classList.add("new");
 
   logList.insertBefore(li, logList.firstChild);
   // Force a reflow so the browser registers the starting state
@@ -135,6 +287,250 @@ function appendLogEntry(m, logList) {
  // logList.scrollTop = logList.scrollHeight;
 }
 
+// --- Fetch the page of rolls before the oldest one shown ---
+function loadOlderRolls(button, logList) {
+  button.disabled = true;
+  const url = HOST_PREFIX + `/api/v1/rooms/${ROOM_ID}/rolls?before=${button.dataset.before}`;
+  fetch(url)
+    .then(res => {
+      if (!res.ok) {
+        throw new Error("HTTP " + res.status);
+      }
+      return res.json();
+    })
+    .then(page => {
+      page.rolls.forEach(m => logList.appendChild(buildLogEntry(m)));
+      applyLogColors();
+      if (page.nextBefore) {
+        button.dataset.before = page.nextBefore;
+        button.disabled = false;
+      } else {
+        button.remove();
+      }
+    })
+    .catch(err => {
+      console.error("Could not load older rolls", err);
+      button.disabled = false;
+    });
+}
+
+// --- Live updates ---
+// The open WebSocket, if any. While it is open rolls are sent over it instead of posting the form.
+let liveSocket = null;
+// Set once a resync has started reloading the page, so nothing tries to reconnect.
+let reloading = false;
+
+// The seq of the newest roll shown, so a new connection only replays what we missed.
+function newestSeq(logList) {
+  const newest = logList.querySelector(".log-entry");
+  return newest ? newest.dataset.seq : 0;
+}
+
+function receiveRoll(m, logList) {
+  // Rolls made while we were reconnecting can arrive twice.
+  if (logList.querySelector(`.log-entry[data-seq="${m.seq}"]`)) {
+    return;
+  }
+  appendLogEntry(m, logList);
+}
+
+function showRollError(message) {
+  const el = document.getElementById("roll-error");
+  if (el) {
+    el.textContent = message;
+    el.hidden = !message;
+  }
+}
+
+// Show a roll the GM has revealed, in place of what we were shown of it or,
+// for a whisper we never saw, in its place in the log.
+function revealRoll(m, logList) {
+  const li = buildLogEntry(m);
+  const old = logList.querySelector(`.log-entry[data-seq="${m.seq}"]`);
+  if (old) {
+    old.replaceWith(li);
+  } else {
+    const older = Array.from(logList.querySelectorAll(".log-entry"))
+      .find(el => Number(el.dataset.seq) < m.seq);
+    if (older) {
+      logList.insertBefore(li, older);
+    } else if (!document.getElementById("load-older")) {
+      logList.appendChild(li);
+    } else {
+      // Older than every roll loaded; it shows up with its page.
+      return;
+    }
+  }
+  applyLogColors();
+}
+
+// Replace the "Players here" list with the one sent with a join or leave.
+function renderPlayers(players) {
+  const list = document.getElementById("players");
+  if (!list) {
+    return;
+  }
+  list.replaceChildren(...players.map(name => {
+    const li = document.createElement("li");
+    const span = document.createElement("span");
+    span.className = "username";
+    span.dataset.name = name;
+    span.textContent = name;
+    span.style.color = pickColor(name);
+    li.appendChild(span);
+    return li;
+  }));
+}
+
+// Show a chat message at the bottom of the chat box.
+function appendChat(m) {
+  const list = document.getElementById("chat");
+  if (!list) {
+    return;
+  }
+  const li = document.createElement("li");
+  const user = document.createElement("span");
+  user.className = "username";
+  user.dataset.name = m.user;
+  user.textContent = m.user;
+  user.style.color = pickColor(m.user);
+  const text = document.createElement("span");
+  text.className = "chat-text";
+  text.textContent = ": " + m.text;
+  const time = document.createElement("span");
+  time.className = "time";
+  time.textContent = m.time;
+  li.append(user, text, time);
+  list.appendChild(li);
+  list.scrollTop = list.scrollHeight;
+}
+
+// Room event handlers by type, mirroring the Event constants in model/models.go.
+const roomEventHandlers = {
+  roll: (payload, logList) => {
+    showRollError("");
+    receiveRoll(payload, logList);
+  },
+  // We fell too far behind and the server cut us off; reload rather than show a log with gaps.
+  resync: () => {
+    reloading = true;
+    window.location.reload();
+  },
+  error: (payload) => showRollError(payload.message),
+  reveal: (payload, logList) => revealRoll(payload, logList),
+  join: (payload) => renderPlayers(payload.players),
+  leave: (payload) => renderPlayers(payload.players),
+  // The answer to our own presence heartbeat.
+  presence: (payload) => renderPlayers(payload.players),
+  chat: (payload) => appendChat(payload),
+  // The GM removed us. The server has ended our stream and our session; the
+  // reload shows the join form, or that we are banned.
+  kick: () => {
+    reloading = true;
+    window.location.reload();
+  },
+};
+
+// Dispatch one {type, id, roomId, payload} envelope from either transport.
+function handleRoomEvent(data, logList) {
+  let ev;
+  try {
+    ev = JSON.parse(data);
+  } catch (err) {
+    console.error("Invalid room event", data, err);
+    return;
+  }
+  const handler = roomEventHandlers[ev.type];
+  if (handler) {
+    handler(ev.payload, logList);
+  }
+}
+
+// How often an open WebSocket tells the server we are still here. The server
+// closes a connection that is silent for 90 seconds.
+const PRESENCE_INTERVAL = 20000;
+
+// Prefer a WebSocket; if one never opens, fall back to EventSource for good.
+function connectLive(logList) {
+  if (!("WebSocket" in window)) {
+    connectEventSource(logList);
+    return;
+  }
+  const scheme = window.location.protocol === "https:" ? "wss:" : "ws:";
+  const url = `${scheme}//${window.location.host}${HOST_PREFIX}/ws/${ROOM_ID}?after=${newestSeq(logList)}`;
+  const ws = new WebSocket(url);
+  let opened = false;
+  let heartbeat = null;
+  ws.onopen = () => {
+    opened = true;
+    liveSocket = ws;
+    heartbeat = setInterval(() => ws.send(JSON.stringify({type: "presence"})), PRESENCE_INTERVAL);
+  };
+  ws.onmessage = (event) => handleRoomEvent(event.data, logList);
+  ws.onclose = () => {
+    liveSocket = null;
+    clearInterval(heartbeat);
+    if (reloading) {
+      return;
+    }
+    if (!opened) {
+      connectEventSource(logList);
+      return;
+    }
+    setTimeout(() => connectLive(logList), 3000);
+  };
+}
+
+// Server-sent events, starting after the newest roll shown. On reconnect the
+// browser sends Last-Event-ID and the server replays what we missed.
+function connectEventSource(logList) {
+  const evtSource = new EventSource(HOST_PREFIX + `/events/${ROOM_ID}?after=${newestSeq(logList)}`);
+  evtSource.onmessage = (event) => {
+    handleRoomEvent(event.data, logList);
+    if (reloading) {
+      evtSource.close();
+    }
+  };
+}
+
+// Send a roll over the open WebSocket instead of posting the form. Returns
+// false if there is no socket and the form should post as usual.
+function rollOverSocket(form) {
+  if (!liveSocket || liveSocket.readyState !== WebSocket.OPEN) {
+    return false;
+  }
+  const expr = form.elements.expr.value.trim() || form.elements.dice.value;
+  const secret = form.elements.secret;
+  const whisper = form.elements.whisper;
+  liveSocket.send(JSON.stringify({
+    type: "roll",
+    expr: expr,
+    desc: form.elements.desc.value,
+    clientSeed: form.elements.clientSeed.value,
+    secret: Boolean(secret && secret.checked),
+    whisper: Boolean(whisper && whisper.checked),
+  }));
+  form.elements.expr.value = "";
+  form.elements.desc.value = "";
+  [secret, whisper].forEach(box => {
+    if (box) {
+      box.checked = false;
+    }
+  });
+  return true;
+}
+
+// Send a chat message over the open WebSocket instead of posting the form.
+// Returns false if there is no socket and the form should post as usual.
+function chatOverSocket(form) {
+  if (!liveSocket || liveSocket.readyState !== WebSocket.OPEN) {
+    return false;
+  }
+  liveSocket.send(JSON.stringify({type: "chat", text: form.elements.text.value}));
+  form.elements.text.value = "";
+  return true;
+}
+
 // --- Initialize on page load ---
 document.addEventListener("DOMContentLoaded", () => {
     const logList = document.getElementById("log");
@@ -154,19 +550,45 @@ document.addEventListener("DOMContentLoaded", () => {
         });
     }
 
+    // A fresh client seed per roll, so the server cannot know it when it commits to its seed.
+    const clientSeed = document.getElementById("clientSeed");
+    if (clientSeed) {
+        clientSeed.form.addEventListener("submit", () => {
+            const bytes = new Uint8Array(16);
+            crypto.getRandomValues(bytes);
+            clientSeed.value = Array.from(bytes, b => b.toString(16).padStart(2, "0")).join("");
+        });
+    }
+
+    // Registered after the client seed listener above, so the seed is already set.
+    const rollForm = document.getElementById("roll-form");
+    if (rollForm) {
+        rollForm.addEventListener("submit", (event) => {
+            if (rollOverSocket(rollForm)) {
+                event.preventDefault();
+            }
+        });
+    }
+
+    const chatForm = document.getElementById("chat-form");
+    if (chatForm) {
+        chatForm.addEventListener("submit", (event) => {
+            if (chatOverSocket(chatForm)) {
+                event.preventDefault();
+            }
+        });
+    }
+
     if (logList) {
   // Style server-rendered entries immediately
         applyLogColors();
 
-  // Connect to SSE
-        const evtSource = new EventSource(HOST_PREFIX + `/events/${ROOM_ID}`);
-        evtSource.onmessage = (event) => {
-            try {
-                const m = JSON.parse(event.data);
-                appendLogEntry(m, logList);
-            } catch (err) {
-            console.error("Invalid SSE payload", event.data, err);
-            }
-        };
+        const loadOlder = document.getElementById("load-older");
+        if (loadOlder) {
+            loadOlder.addEventListener("click", () => loadOlderRolls(loadOlder, logList));
+        }
+
+  // Live updates and rolls over a WebSocket, or server-sent events if it won't connect
+        connectLive(logList);
     }
 });
\ No newline at end of file
@@ -0,0 +1,106 @@
+package bullet_store
+
+import (
+	"dice_room/model"
+	"dice_room/store"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vixac/firbolg_clients/bullet/bullet_interface"
+	bullet_stl "github.com/vixac/firbolg_clients/bullet/bullet_stl/containers"
+)
+
+// BanRecord is a ban as stored. Lifting a ban writes a second, lifted copy
+// under a new key rather than deleting the first, and a lifted copy always wins.
+type BanRecord struct {
+	Ban    model.Ban `json:"ban"`
+	Lifted bool      `json:"lifted,omitempty"`
+}
+
+// BanCollection stores each room's bans and kicks under roomId:banId:createdMillis.
+type BanCollection struct {
+	Codec      Codec[BanRecord]
+	Collection bullet_stl.Collection
+}
+
+func NewBanCollection(bucketId int32, client bullet_interface.BulletClientInterface, codec Codec[BanRecord]) BanCollection {
+	coll := bullet_stl.NewBulletCollection(bucketId, client, client)
+	return BanCollection{
+		Collection: coll,
+		Codec:      codec,
+	}
+}
+
+func (b *BanCollection) saveRecord(room RoomId, record BanRecord) error {
+	now := time.Now()
+	encoded, err := b.Codec.Encode(record)
+	if err != nil {
+		return err
+	}
+	key := room.Id + ":" + record.Ban.ID + ":" + TimeToMillisString(now)
+	_, err = b.Collection.CreateItemUnder(key, encoded, &now)
+	return err
+}
+
+func (b *BanCollection) AddBan(room RoomId, ban model.Ban) error {
+	return b.saveRecord(room, BanRecord{Ban: ban})
+}
+
+// records returns the room's bans by id, lifted ones included.
+func (b *BanCollection) records(room RoomId) (map[string]BanRecord, error) {
+	items, err := b.Collection.AllItemsUnderPrefix(room.Id + ":")
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[string]BanRecord)
+	for k, v := range items {
+		split := strings.Split(k.Key, ":")
+		if len(split) != 3 || split[0] != room.Id {
+			return nil, errors.New("invalid ban key")
+		}
+		var record BanRecord
+		if err := b.Codec.Decode(v.Payload, &record); err != nil {
+			return nil, err
+		}
+		if _, ok := byId[record.Ban.ID]; !ok || record.Lifted {
+			byId[record.Ban.ID] = record
+		}
+	}
+	return byId, nil
+}
+
+// BansForRoom returns the room's bans that have not been lifted, oldest first.
+func (b *BanCollection) BansForRoom(room RoomId) ([]model.Ban, error) {
+	records, err := b.records(room)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	bans := make([]model.Ban, 0, len(records))
+	for _, record := range records {
+		if !record.Lifted {
+			bans = append(bans, record.Ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Created != bans[j].Created {
+			return bans[i].Created < bans[j].Created
+		}
+		return bans[i].ID < bans[j].ID
+	})
+	return bans, nil
+}
+
+func (b *BanCollection) LiftBan(room RoomId, banId string) error {
+	records, err := b.records(room)
+	if err != nil {
+		return err
+	}
+	record, ok := records[banId]
+	if !ok || record.Lifted {
+		return store.ErrBanNotFound
+	}
+	record.Lifted = true
+	return b.saveRecord(room, record)
+}
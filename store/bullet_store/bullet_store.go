@@ -10,12 +10,22 @@ import (
 const (
 	roomBuckId   int32 = 3000
 	rollBucketId int32 = 3001
+	diceBucketId int32 = 3002
+	seedBucketId int32 = 3003
+	banBucketId  int32 = 3004
+	eventBuckId  int32 = 3005
+	ipBucketId   int32 = 3006
 )
 
 type BulletRoomStore struct {
-	Client bullet_interface.BulletClientInterface
-	Rooms  *RoomCollection
-	Rolls  *RollCollection
+	Client  bullet_interface.BulletClientInterface
+	Rooms   *RoomCollection
+	Rolls   *RollCollection
+	Dice    *DiceCollection
+	Seeds   *SeedCollection
+	BanList *BanCollection
+	Events  *EventCollection
+	IPs     *PlayerIPCollection
 }
 
 func NewBulletStore(client bullet_interface.BulletClientInterface) store.Store {
@@ -24,10 +34,24 @@ func NewBulletStore(client bullet_interface.BulletClientInterface) store.Store {
 	rooms := NewRoomCollection(roomBuckId, client, &roomCodec)
 	rollCodec := JSONCodec[model.LogEntry]{}
 	rolls := NewRollCollection(rollBucketId, client, &rollCodec)
+	diceCodec := JSONCodec[model.CustomDie]{}
+	dice := NewDiceCollection(diceBucketId, client, &diceCodec)
+	seedCodec := JSONCodec[model.ServerSeed]{}
+	seeds := NewSeedCollection(seedBucketId, client, &seedCodec)
+	banCodec := JSONCodec[BanRecord]{}
+	bans := NewBanCollection(banBucketId, client, &banCodec)
+	eventCodec := JSONCodec[EventRecord]{}
+	events := NewEventCollection(eventBuckId, client, &eventCodec)
+	ips := NewPlayerIPCollection(ipBucketId, client)
 	return &BulletRoomStore{
-		Client: client,
-		Rooms:  &rooms,
-		Rolls:  &rolls,
+		Client:  client,
+		Rooms:   &rooms,
+		Rolls:   &rolls,
+		Dice:    &dice,
+		Seeds:   &seeds,
+		BanList: &bans,
+		Events:  &events,
+		IPs:     &ips,
 	}
 }
 
@@ -36,20 +60,29 @@ func roomIdFor(name string) RoomId {
 		Id: name,
 	}
 }
-func (b *BulletRoomStore) CreateRoom(name string) (*model.Room, error) {
+func (b *BulletRoomStore) CreateRoom(name string, seed model.ServerSeed, gmKey, passphrase string) (*model.Room, error) {
 	//Room can use a collection for the payloads
 	//and for the entries, we can just have another collection
 	//that uses room id as a prefix. Easy.
 
-	id, err := b.Rooms.CreateRoom(name)
+	id, err := b.Rooms.CreateRoom(name, gmKey, passphrase)
 
 	if err != nil {
 		return nil, err
 	}
-	return &model.Room{
-		Id:       id.Id,
-		RoomName: name,
-	}, nil
+	room := model.Room{
+		Id:         id.Id,
+		RoomName:   name,
+		GMKey:      gmKey,
+		Passphrase: passphrase,
+	}
+	if seed.Hash != "" {
+		if err := b.Seeds.SaveSeed(*id, seed); err != nil {
+			return nil, err
+		}
+		room.Seeds = []model.ServerSeed{seed}
+	}
+	return &room, nil
 
 }
 
@@ -59,16 +92,114 @@ func (b *BulletRoomStore) GetRoom(id string) (*model.Room, error) {
 	if err != nil || roomInfo == nil {
 		return nil, err
 	}
-	logs, err := b.Rolls.RollsForRoom(roomId) //VX:TODO paging one day.
+	customDice, err := b.Dice.DiceForRoom(roomId)
+	if err != nil {
+		return nil, err
+	}
+	seeds, err := b.Seeds.SeedsForRoom(roomId)
 	room := model.Room{
-		Id:       roomInfo.Id,
-		RoomName: roomInfo.Name,
-		Log:      logs,
+		Id:         roomInfo.Id,
+		RoomName:   roomInfo.Name,
+		CustomDice: customDice,
+		Seeds:      seeds,
+		GMKey:      roomInfo.GMKey,
+		Passphrase: roomInfo.Passphrase,
 	}
-	room.Log = logs
 	return &room, err
 }
 
-func (b *BulletRoomStore) AddEntry(roomID string, entry model.LogEntry) error {
+func (b *BulletRoomStore) AddEntry(roomID string, entry *model.LogEntry) error {
 	return b.Rolls.AddRoll(roomIdFor(roomID), entry)
 }
+
+func (b *BulletRoomStore) AddEntryFor(roomID string, roll func(seq int64) (model.LogEntry, error)) (*model.LogEntry, error) {
+	return b.Rolls.AddRollFor(roomIdFor(roomID), roll)
+}
+
+func (b *BulletRoomStore) RevealRoll(roomID string, seq int64) (*model.LogEntry, error) {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return nil, err
+	}
+	return b.Rolls.RevealRoll(roomId, seq)
+}
+
+func (b *BulletRoomStore) RecentRolls(roomID string, before int64, limit int) ([]model.LogEntry, error) {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return nil, err
+	}
+	return b.Rolls.RecentRolls(roomId, before, limit)
+}
+
+func (b *BulletRoomStore) SaveCustomDie(roomID string, die model.CustomDie) error {
+	return b.Dice.SaveDie(roomIdFor(roomID), die)
+}
+
+func (b *BulletRoomStore) RotateSeed(roomID string, next model.ServerSeed) error {
+	return b.Seeds.RotateSeed(roomIdFor(roomID), next)
+}
+
+func (b *BulletRoomStore) AddBan(roomID string, ban model.Ban) error {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return err
+	}
+	return b.BanList.AddBan(roomId, ban)
+}
+
+func (b *BulletRoomStore) Bans(roomID string) ([]model.Ban, error) {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return nil, err
+	}
+	return b.BanList.BansForRoom(roomId)
+}
+
+func (b *BulletRoomStore) LiftBan(roomID, banID string) error {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return err
+	}
+	return b.BanList.LiftBan(roomId, banID)
+}
+
+func (b *BulletRoomStore) AppendEvent(roomID, payload string) (int64, error) {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return 0, err
+	}
+	return b.Events.AppendEvent(roomId, payload)
+}
+
+func (b *BulletRoomStore) EventsAfter(roomID string, after int64, limit int) ([]store.OutboxEvent, error) {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return nil, err
+	}
+	return b.Events.EventsAfter(roomId, after, limit)
+}
+
+func (b *BulletRoomStore) LastEventID(roomID string) (int64, error) {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return 0, err
+	}
+	return b.Events.LastEventID(roomId)
+}
+
+func (b *BulletRoomStore) SetPlayerIP(roomID, playerID, ip string) error {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return err
+	}
+	return b.IPs.SetPlayerIP(roomId, playerID, ip)
+}
+
+func (b *BulletRoomStore) PlayerIP(roomID, playerID string) (string, error) {
+	roomId := roomIdFor(roomID)
+	if _, err := b.Rooms.GetRoom(roomId); err != nil {
+		return "", err
+	}
+	return b.IPs.PlayerIP(roomId, playerID)
+}
@@ -0,0 +1,166 @@
+package bullet_store
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	bullet_stl "github.com/vixac/firbolg_clients/bullet/bullet_stl/containers"
+)
+
+// claimLog numbers the items of a room's log, the rolls or the outbox events,
+// by claiming ids, in the key layout of the roll log.
+type claimLog struct {
+	Collection RollItems
+	// heads holds the highest id this process has seen claimed in each room,
+	// as a place to start looking for the room's newest item.
+	heads *sync.Map
+	// turns holds a mutex for each room that writers in this process take
+	// turns with.
+	turns *sync.Map
+}
+
+func newClaimLog(items RollItems) claimLog {
+	return claimLog{Collection: items, heads: &sync.Map{}, turns: &sync.Map{}}
+}
+
+// newClaimToken returns a random token that tells one writer's claims apart
+// from every other's.
+func newClaimToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// highestIn returns the highest id claimed in a read of the log, or 0 if
+// there are none.
+func highestIn(items map[bullet_stl.CollectionId]bullet_stl.CollectionItem) (int64, error) {
+	var highest int64
+	for k := range items {
+		key, ok, err := parseRollKey(k.Key)
+		if err != nil {
+			return 0, err
+		}
+		if ok && key.Seq > highest {
+			highest = key.Seq
+		}
+	}
+	return highest, nil
+}
+
+// head returns the highest id claimed in the room, won or not, or FirstEntryId
+// if there are none. Writers only claim the id after the highest they have
+// seen, so claims fill the ids from the first without gaps, and the blocks
+// holding any are exactly those up to the head's. head gallops forward from
+// the last head this process saw until it reaches an empty block, then
+// bisects back to the last one that is not. When this process has kept up,
+// the first block it reads stops short of its end, and that is the only read.
+func (l *claimLog) head(room RoomId) (int64, error) {
+	first := FirstEntryId().IntValue
+	start := block(first + 1)
+	if seen, ok := l.heads.Load(room.Id); ok {
+		start = block(seen.(int64))
+	}
+	// lo is the highest block known to hold claims, highest the highest claim
+	// in it, and hi the lowest block known to hold none, or 0 until one is.
+	lo, hi, highest := block(first+1)-1, int64(0), first
+	probe := func(b int64) error {
+		items, err := l.Collection.AllItemsUnderPrefix(blockPrefix(room, b))
+		if err != nil {
+			return err
+		}
+		h, err := highestIn(items)
+		if err != nil {
+			return err
+		}
+		switch {
+		case h == 0:
+			hi = b
+		case h < (b+1)*blockSize-1:
+			lo, hi, highest = b, b+1, h
+		default:
+			lo, highest = b, h
+		}
+		return nil
+	}
+	for step, b := int64(1), start; hi == 0; step, b = step*2, lo+step {
+		if err := probe(b); err != nil {
+			return 0, err
+		}
+	}
+	for hi-lo > 1 {
+		if err := probe(lo + (hi-lo)/2); err != nil {
+			return 0, err
+		}
+	}
+	if highest > first {
+		l.heads.Store(room.Id, highest)
+	}
+	return highest, nil
+}
+
+// add stores an item under the next free id in its room and returns the id.
+// encode makes the item's payload for the id it is about to claim. Bullet has
+// no compare-and-set, so writers, in this process or any other, agree on ids
+// by claiming: each writes a claim on the id it wants and reads the id back,
+// and takes it only if its claim is there alone. Of two claims on one id,
+// whichever is written second is seen by both reads, so at most one writer can
+// take an id. The others wait a moment and try the next. Writers in this
+// process take turns in each room, so only writers in other processes race
+// for an id: when many claims on one id race, they can all lose, again and
+// again.
+func (l *claimLog) add(room RoomId, encode func(seq int64) (string, error)) (int64, error) {
+	turn, _ := l.turns.LoadOrStore(room.Id, &sync.Mutex{})
+	turn.(*sync.Mutex).Lock()
+	defer turn.(*sync.Mutex).Unlock()
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(rand.N(time.Millisecond << min(attempt, 5)))
+		}
+		head, err := l.head(room)
+		if err != nil {
+			return 0, err
+		}
+		seq := head + 1
+		payload, err := encode(seq)
+		if err != nil {
+			return 0, err
+		}
+		won, err := l.claim(room, seq, payload)
+		if err != nil {
+			return 0, err
+		}
+		if won {
+			l.heads.Store(room.Id, seq)
+			return seq, nil
+		}
+	}
+	return 0, fmt.Errorf("no free id in room %s after %d attempts", room.Id, maxClaimAttempts)
+}
+
+// claim tries to take seq for payload, reporting whether it did.
+func (l *claimLog) claim(room RoomId, seq int64, payload string) (bool, error) {
+	token, err := newClaimToken()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	prefix := seqPrefix(room, seq)
+	key := prefix + claimKind + ":" + token
+	if err := l.Collection.CreateItem(key, payload, &now); err != nil {
+		return false, err
+	}
+	claims, err := l.Collection.AllItemsUnderPrefix(prefix)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := claims[bullet_stl.CollectionId{Key: key}]; !ok || len(claims) != 1 {
+		return false, nil
+	}
+	return true, l.Collection.CreateItem(prefix+wonKind+":"+token, "", &now)
+}
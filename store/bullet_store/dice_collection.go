@@ -0,0 +1,82 @@
+package bullet_store
+
+import (
+	"dice_room/model"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vixac/firbolg_clients/bullet/bullet_interface"
+	bullet_stl "github.com/vixac/firbolg_clients/bullet/bullet_stl/containers"
+)
+
+// DiceCollection stores each room's custom dice. Saving a die never rewrites an
+// item: a new version is written under roomId:name:createdMillis and the latest wins.
+type DiceCollection struct {
+	Codec      Codec[model.CustomDie]
+	Collection bullet_stl.Collection
+}
+
+func NewDiceCollection(bucketId int32, client bullet_interface.BulletClientInterface, codec Codec[model.CustomDie]) DiceCollection {
+	coll := bullet_stl.NewBulletCollection(bucketId, client, client)
+	return DiceCollection{
+		Collection: coll,
+		Codec:      codec,
+	}
+}
+
+func (d *DiceCollection) SaveDie(room RoomId, die model.CustomDie) error {
+	now := time.Now()
+	encoded, err := d.Codec.Encode(die)
+	if err != nil {
+		return err
+	}
+	key := room.Id + ":" + die.Name + ":" + TimeToMillisString(now)
+	_, err = d.Collection.CreateItemUnder(key, encoded, &now)
+	return err
+}
+
+func (d *DiceCollection) DiceForRoom(room RoomId) ([]model.CustomDie, error) {
+	items, err := d.Collection.AllItemsUnderPrefix(room.Id + ":")
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	type version struct {
+		die     model.CustomDie
+		created string
+	}
+	latest := make(map[string]version)
+	for k, v := range items {
+		split := strings.Split(k.Key, ":")
+		if len(split) != 3 || split[0] != room.Id {
+			return nil, errors.New("invalid custom die key")
+		}
+		var die model.CustomDie
+		if err := d.Codec.Decode(v.Payload, &die); err != nil {
+			return nil, err
+		}
+		created := split[2]
+		if existing, ok := latest[die.Name]; !ok || newerMillis(created, existing.created) {
+			latest[die.Name] = version{die: die, created: created}
+		}
+	}
+
+	dice := make([]model.CustomDie, 0, len(latest))
+	for _, v := range latest {
+		dice = append(dice, v.die)
+	}
+	sort.Slice(dice, func(i, j int) bool {
+		return dice[i].Name < dice[j].Name
+	})
+	return dice, nil
+}
+
+// newerMillis compares two epoch millisecond strings.
+func newerMillis(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
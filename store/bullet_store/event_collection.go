@@ -0,0 +1,115 @@
+package bullet_store
+
+import (
+	"dice_room/store"
+	"fmt"
+	"time"
+
+	"github.com/vixac/firbolg_clients/bullet/bullet_interface"
+	bullet_stl "github.com/vixac/firbolg_clients/bullet/bullet_stl/containers"
+)
+
+// eventClaimTimeout is how long a reader waits for a claimed event id to be
+// won before deciding that every claim on it lost.
+const eventClaimTimeout = 10 * time.Second
+
+// EventRecord is an outbox event as stored in its claim.
+type EventRecord struct {
+	Created int64  `json:"created"`
+	Payload string `json:"payload"`
+}
+
+// EventCollection is each room's outbox of live events, numbered by claiming
+// ids the way rolls are.
+type EventCollection struct {
+	Codec Codec[EventRecord]
+	log   claimLog
+}
+
+func NewEventCollection(bucketId int32, client bullet_interface.BulletClientInterface, codec Codec[EventRecord]) EventCollection {
+	coll := bullet_stl.NewBulletCollection(bucketId, client, client)
+	return newEventCollection(bulletRollItems{coll}, codec)
+}
+
+func newEventCollection(items RollItems, codec Codec[EventRecord]) EventCollection {
+	return EventCollection{Codec: codec, log: newClaimLog(items)}
+}
+
+func (e *EventCollection) AppendEvent(room RoomId, payload string) (int64, error) {
+	encoded, err := e.Codec.Encode(EventRecord{Created: time.Now().UnixMilli(), Payload: payload})
+	if err != nil {
+		return 0, err
+	}
+	return e.log.add(room, func(int64) (string, error) { return encoded, nil })
+}
+
+// EventsAfter returns up to limit events with an id above after, oldest
+// first, reading a block of ids at a time. An id that has claims but no
+// winner is either about to be won or was lost by every writer that claimed
+// it. While its claims are recent the read stops short of it, so that no
+// event is passed over before it can be seen; once they are older than
+// eventClaimTimeout it is skipped.
+func (e *EventCollection) EventsAfter(room RoomId, after int64, limit int) ([]store.OutboxEvent, error) {
+	seq := max(after, FirstEntryId().IntValue) + 1
+	var events []store.OutboxEvent
+	for len(events) < limit {
+		items, err := e.log.Collection.AllItemsUnderPrefix(blockPrefix(room, block(seq)))
+		if err != nil {
+			return nil, err
+		}
+		claims := make(map[int64]map[string]string)
+		winners := make(map[int64]string)
+		for k, v := range items {
+			key, ok, err := parseRollKey(k.Key)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case !ok:
+			case key.Kind == claimKind:
+				if claims[key.Seq] == nil {
+					claims[key.Seq] = make(map[string]string)
+				}
+				claims[key.Seq][key.Token] = v.Payload
+			case key.Kind == wonKind:
+				winners[key.Seq] = key.Token
+			}
+		}
+		for end := (block(seq) + 1) * blockSize; seq < end && len(events) < limit; seq++ {
+			if token, ok := winners[seq]; ok {
+				payload, ok := claims[seq][token]
+				if !ok {
+					return nil, fmt.Errorf("room %s has no claim for event %d", room.Id, seq)
+				}
+				var record EventRecord
+				if err := e.Codec.Decode(payload, &record); err != nil {
+					return nil, err
+				}
+				events = append(events, store.OutboxEvent{ID: seq, Payload: record.Payload})
+				continue
+			}
+			if len(claims[seq]) == 0 {
+				return events, nil
+			}
+			for _, payload := range claims[seq] {
+				var record EventRecord
+				if err := e.Codec.Decode(payload, &record); err != nil {
+					return nil, err
+				}
+				if time.Since(time.UnixMilli(record.Created)) < eventClaimTimeout {
+					return events, nil
+				}
+			}
+		}
+	}
+	return events, nil
+}
+
+// LastEventID is the highest event id claimed in the room, or 0 if none are.
+func (e *EventCollection) LastEventID(room RoomId) (int64, error) {
+	head, err := e.log.head(room)
+	if err != nil || head == FirstEntryId().IntValue {
+		return 0, err
+	}
+	return head, nil
+}
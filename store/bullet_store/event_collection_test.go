@@ -0,0 +1,74 @@
+package bullet_store
+
+import (
+	"dice_room/store"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEventsAfterPagesInOrder(t *testing.T) {
+	coll := newEventCollection(bulletRollItems{newFakeCollection()}, &JSONCodec[EventRecord]{})
+	room := RoomId{Id: "room1"}
+	if id, err := coll.LastEventID(room); err != nil || id != 0 {
+		t.Fatalf("empty outbox: last id = %d, %v", id, err)
+	}
+	var want []store.OutboxEvent
+	for i := 0; i < 150; i++ {
+		payload := strconv.Itoa(i)
+		id, err := coll.AppendEvent(room, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, store.OutboxEvent{ID: id, Payload: payload})
+	}
+	if id, _ := coll.LastEventID(room); id != want[len(want)-1].ID {
+		t.Errorf("last id = %d, want %d", id, want[len(want)-1].ID)
+	}
+
+	var got []store.OutboxEvent
+	for after := int64(0); ; {
+		page, err := coll.EventsAfter(room, after, 40)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		got = append(got, page...)
+		after = page[len(page)-1].ID
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged events = %+v, want %+v", got, want)
+	}
+}
+
+func TestEventsAfterWaitsForRecentClaims(t *testing.T) {
+	items := newFakeCollection()
+	coll := newEventCollection(bulletRollItems{items}, &JSONCodec[EventRecord]{})
+	room := RoomId{Id: "room1"}
+	first, err := coll.AppendEvent(room, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two claims on the next id, neither of which won.
+	claim := func(token string, created time.Time) {
+		encoded, _ := coll.Codec.Encode(EventRecord{Created: created.UnixMilli(), Payload: token})
+		items.write(seqPrefix(room, first+1)+claimKind+":"+token, encoded)
+	}
+	claim("a", time.Now().Add(-time.Minute))
+	claim("b", time.Now())
+	if _, err := coll.AppendEvent(room, "after"); err != nil {
+		t.Fatal(err)
+	}
+
+	if events, _ := coll.EventsAfter(room, 0, 10); len(events) != 1 || events[0].Payload != "first" {
+		t.Errorf("with a recent claim pending: events = %+v, want only the first", events)
+	}
+	claim("b", time.Now().Add(-time.Minute))
+	events, err := coll.EventsAfter(room, first, 10)
+	if err != nil || len(events) != 1 || events[0].Payload != "after" || events[0].ID != first+2 {
+		t.Errorf("with only stale claims: events = %+v, %v, want the event after them", events, err)
+	}
+}
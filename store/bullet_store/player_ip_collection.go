@@ -0,0 +1,58 @@
+package bullet_store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vixac/firbolg_clients/bullet/bullet_interface"
+	bullet_stl "github.com/vixac/firbolg_clients/bullet/bullet_stl/containers"
+)
+
+// PlayerIPCollection stores the addresses players connect to each room from
+// under roomId:playerId:createdMillis, with the address as the payload. The
+// newest is the player's address. A new item is only written when a player's
+// address changes.
+type PlayerIPCollection struct {
+	Collection bullet_stl.Collection
+}
+
+func NewPlayerIPCollection(bucketId int32, client bullet_interface.BulletClientInterface) PlayerIPCollection {
+	return PlayerIPCollection{Collection: bullet_stl.NewBulletCollection(bucketId, client, client)}
+}
+
+func (p *PlayerIPCollection) SetPlayerIP(room RoomId, playerId, ip string) error {
+	current, err := p.PlayerIP(room, playerId)
+	if err != nil || current == ip {
+		return err
+	}
+	now := time.Now()
+	key := room.Id + ":" + playerId + ":" + TimeToMillisString(now)
+	_, err = p.Collection.CreateItemUnder(key, ip, &now)
+	return err
+}
+
+// PlayerIP returns the player's newest address in the room, or "".
+func (p *PlayerIPCollection) PlayerIP(room RoomId, playerId string) (string, error) {
+	items, err := p.Collection.AllItemsUnderPrefix(room.Id + ":" + playerId + ":")
+	if err != nil {
+		return "", err
+	}
+	var ip string
+	newest := int64(-1)
+	for k, v := range items {
+		split := strings.Split(k.Key, ":")
+		if len(split) != 3 || split[0] != room.Id || split[1] != playerId {
+			return "", errors.New("invalid player address key")
+		}
+		created, err := strconv.ParseInt(split[2], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		if created > newest {
+			newest, ip = created, v.Payload
+		}
+	}
+	return ip, nil
+}
@@ -2,11 +2,14 @@ package bullet_store
 
 import (
 	"dice_room/model"
+	"dice_room/store"
 	"errors"
 	"fmt"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/vixac/firbolg_clients/bullet/bullet_interface"
@@ -38,9 +41,53 @@ func (k *LogId) ToString() string {
 	return k.RoomId.Id + ":" + k.EntryId.AasciValue + ":" + createdStr
 }
 
+// The roll log of a room is kept under these keys, where seq is the roll's
+// id zero-padded so that a room's keys sort by it, and so that the ids in each
+// block of a hundred share a prefix:
+//
+//	roomId:seq:c:token                a writer's claim on seq, holding its roll
+//	roomId:seq:w:token                marks the claim that won seq
+//	roomId:seq:r:token:createdMillis  a revealed copy of the roll that won seq
+//	roomId:~migrated                  the room's legacy rolls have been copied
+//
+// Rolls written before claims are under roomId:base36 seq:createdMillis. They
+// are copied to winning claims with the token "legacy" the first time the
+// room is touched, and never read again after that. A room's outbox uses the
+// same layout for its events, without reveals or legacy keys.
+const (
+	seqWidth    = 12
+	blockDigits = 2
+	blockSize   = 100
+	claimKind   = "c"
+	wonKind     = "w"
+	revealKind  = "r"
+	legacyToken = "legacy"
+	migratedKey = "~migrated"
+
+	maxClaimAttempts = 50
+)
+
 type RollCollection struct {
 	Codec      Codec[model.LogEntry]
-	Collection bullet_stl.Collection
+	Collection RollItems
+	migrated   *sync.Map
+	log        claimLog
+}
+
+// RollItems is the part of a bullet collection that the roll log needs.
+type RollItems interface {
+	AllItemsUnderPrefix(prefix string) (map[bullet_stl.CollectionId]bullet_stl.CollectionItem, error)
+	CreateItem(key string, payload string, created *time.Time) error
+}
+
+// bulletRollItems adapts a bullet_stl.Collection to RollItems.
+type bulletRollItems struct {
+	bullet_stl.Collection
+}
+
+func (b bulletRollItems) CreateItem(key string, payload string, created *time.Time) error {
+	_, err := b.CreateItemUnder(key, payload, created)
+	return err
 }
 
 func FirstEntryId() ids.BulletId {
@@ -51,12 +98,67 @@ func FirstEntryId() ids.BulletId {
 // for storing room info which is basically nothing for now.
 func NewRollCollection(bucketId int32, client bullet_interface.BulletClientInterface, codec Codec[model.LogEntry]) RollCollection {
 	coll := bullet_stl.NewBulletCollection(bucketId, client, client)
+	return newRollCollection(bulletRollItems{coll}, codec)
+}
+
+func newRollCollection(items RollItems, codec Codec[model.LogEntry]) RollCollection {
 	return RollCollection{
-		Collection: coll,
+		Collection: items,
 		Codec:      codec,
+		migrated:   &sync.Map{},
+		log:        newClaimLog(items),
 	}
 }
 
+// rollPrefix is the key prefix of every roll in a room. The trailing colon
+// stops one room id from matching another that it happens to prefix.
+func rollPrefix(room RoomId) string {
+	return room.Id + ":"
+}
+
+// seqPrefix is the key prefix of everything stored for one roll id.
+func seqPrefix(room RoomId, seq int64) string {
+	return fmt.Sprintf("%s:%0*d:", room.Id, seqWidth, seq)
+}
+
+// block is the block of a hundred ids that seq is in.
+func block(seq int64) int64 {
+	return seq / blockSize
+}
+
+// blockPrefix is the key prefix of everything stored for the ids in block b.
+func blockPrefix(room RoomId, b int64) string {
+	return fmt.Sprintf("%s:%0*d", room.Id, seqWidth-blockDigits, b)
+}
+
+// rollKey is a parsed key from the roll log.
+type rollKey struct {
+	Seq   int64
+	Kind  string
+	Token string
+}
+
+// parseRollKey parses a claim, win or reveal key. It reports false for the
+// room's other keys: legacy rolls and the migration marker.
+func parseRollKey(key string) (rollKey, bool, error) {
+	split := strings.Split(key, ":")
+	if len(split) < 4 {
+		return rollKey{}, false, nil
+	}
+	seq, err := strconv.ParseInt(split[1], 10, 64)
+	if err != nil || len(split[1]) != seqWidth {
+		return rollKey{}, false, fmt.Errorf("invalid roll key %q", key)
+	}
+	k := rollKey{Seq: seq, Kind: split[2], Token: split[3]}
+	switch {
+	case (k.Kind == claimKind || k.Kind == wonKind) && len(split) == 4:
+	case k.Kind == revealKind && len(split) == 5:
+	default:
+		return rollKey{}, false, fmt.Errorf("invalid roll key %q", key)
+	}
+	return k, true, nil
+}
+
 func NewLogIdFromString(input string) (*LogId, error) {
 	split := strings.Split(input, ":")
 	if len(split) != 3 {
@@ -84,65 +186,140 @@ func NewLogIdFromString(input string) (*LogId, error) {
 	return &longForm, nil
 }
 
-func highestIdInside(collection map[bullet_stl.CollectionId]bullet_stl.CollectionItem) (*ids.BulletId, error) {
-	if len(collection) == 0 {
-		return nil, nil
-	}
-	var highestIntValue int64 = 0
-	for k, _ := range collection {
-
-		logId, err := NewLogIdFromString(k.Key)
-		if err != nil {
-			return nil, err
-		}
-		if logId.EntryId.IntValue > highestIntValue {
-			highestIntValue = logId.EntryId.IntValue
-		}
+// AddRoll stores a roll under the next free id in its room and sets the roll's
+// Seq to that id.
+func (r *RollCollection) AddRoll(room RoomId, roll *model.LogEntry) error {
+	added, err := r.AddRollFor(room, func(int64) (model.LogEntry, error) {
+		return *roll, nil
+	})
+	if err != nil {
+		return err
 	}
-	return ids.NewBulletIdFromInt(highestIntValue)
+	roll.Seq = added.Seq
+	return nil
 }
 
-func (r *RollCollection) NextIdForRoom(room RoomId, now time.Time) (*LogId, error) {
-	existing, err := r.Collection.AllItemsUnderPrefix(room.Id)
-	if err != nil {
+// AddRollFor adds the roll that roll makes for the id it is about to claim.
+// roll is called again for each id tried.
+func (r *RollCollection) AddRollFor(room RoomId, roll func(seq int64) (model.LogEntry, error)) (*model.LogEntry, error) {
+	if err := r.migrate(room); err != nil {
 		return nil, err
 	}
-
-	highestExistingId, err := highestIdInside(existing)
+	var claimed model.LogEntry
+	_, err := r.log.add(room, func(seq int64) (string, error) {
+		var err error
+		if claimed, err = roll(seq); err != nil {
+			return "", err
+		}
+		claimed.Seq = seq
+		return r.Codec.Encode(claimed)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if highestExistingId == nil { //this is the first note for this gotid
-		first := FirstEntryId()
-		highestExistingId = &first
-	}
-
-	newLogId := LogId{
-		RoomId:      room,
-		EntryId:     highestExistingId.Next(),
-		CreatedTime: now,
-	}
-	return &newLogId, nil
+	return &claimed, nil
+}
 
+// wonRoll is a roll in the log with the token of the claim that won its id.
+type wonRoll struct {
+	Token string
+	Entry model.LogEntry
 }
 
-func (r *RollCollection) AddRoll(room RoomId, roll model.LogEntry) error {
-	now := time.Now()
+// wonRolls picks out the rolls that won their ids from a read of the log,
+// ordered by Seq, each replaced by its revealed copy if it has one. Claims
+// that lost, or have not yet won, are skipped.
+func (r *RollCollection) wonRolls(room RoomId, items map[bullet_stl.CollectionId]bullet_stl.CollectionItem) ([]wonRoll, error) {
+	payloads := make(map[rollKey]string)
+	winners := make(map[int64]string)
+	for k, v := range items {
+		key, ok, err := parseRollKey(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		switch key.Kind {
+		case wonKind:
+			if token, ok := winners[key.Seq]; ok && token != key.Token {
+				return nil, fmt.Errorf("room %s has two rolls with id %d", room.Id, key.Seq)
+			}
+			winners[key.Seq] = key.Token
+		default:
+			// Copies of one reveal differ only in when they were written.
+			payloads[rollKey{Seq: key.Seq, Kind: key.Kind, Token: key.Token}] = v.Payload
+		}
+	}
 
-	newId, err := r.NextIdForRoom(room, now)
-	if err != nil {
-		return err
+	rolls := make([]wonRoll, 0, len(winners))
+	for seq, token := range winners {
+		payload, ok := payloads[rollKey{Seq: seq, Kind: revealKind, Token: token}]
+		if !ok {
+			payload, ok = payloads[rollKey{Seq: seq, Kind: claimKind, Token: token}]
+		}
+		if !ok {
+			return nil, fmt.Errorf("room %s has no claim for roll %d", room.Id, seq)
+		}
+		var entry model.LogEntry
+		if err := r.Codec.Decode(payload, &entry); err != nil {
+			return nil, err
+		}
+		entry.Seq = seq
+		rolls = append(rolls, wonRoll{Token: token, Entry: entry})
 	}
-	newStringId := newId.ToString()
+	sort.Slice(rolls, func(i, j int) bool {
+		return rolls[i].Entry.Seq < rolls[j].Entry.Seq
+	})
+	return rolls, nil
+}
 
-	encoded, err := r.Codec.Encode(roll)
-	if err != nil {
-		return err
+// migrate copies the room's legacy rolls into the claim layout, once. Every
+// copy goes under a key fixed by the roll it copies, so processes that find
+// the room unmigrated at the same time write the same items.
+func (r *RollCollection) migrate(room RoomId) error {
+	if _, ok := r.migrated.Load(room.Id); ok {
+		return nil
 	}
-	_, err = r.Collection.CreateItemUnder(newStringId, encoded, &now)
+	marker, err := r.Collection.AllItemsUnderPrefix(rollPrefix(room) + migratedKey)
 	if err != nil {
 		return err
 	}
+	if len(marker) == 0 {
+		all, err := r.Collection.AllItemsUnderPrefix(rollPrefix(room))
+		if err != nil {
+			return err
+		}
+		legacy := make(map[bullet_stl.CollectionId]bullet_stl.CollectionItem)
+		for k, v := range all {
+			if strings.Count(k.Key, ":") == 2 {
+				legacy[k] = v
+			}
+		}
+		entries, err := r.legacyRolls(room, legacy)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			prefix := seqPrefix(room, entry.Seq)
+			encoded, err := r.Codec.Encode(entry)
+			if err != nil {
+				return err
+			}
+			created := time.UnixMilli(entry.UnixMillis)
+			if err := r.Collection.CreateItem(prefix+claimKind+":"+legacyToken, encoded, &created); err != nil {
+				return err
+			}
+			if err := r.Collection.CreateItem(prefix+wonKind+":"+legacyToken, "", &created); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		if err := r.Collection.CreateItem(rollPrefix(room)+migratedKey, "", &now); err != nil {
+			return err
+		}
+	}
+	r.migrated.Store(room.Id, true)
 	return nil
 }
 
@@ -159,6 +336,7 @@ func (r *RollCollection) collectionToLongFormMap(collection map[bullet_stl.Colle
 		if err := r.Codec.Decode(v.Payload, &entry); err != nil {
 			return nil, err
 		}
+		entry.Seq = logId.EntryId.IntValue
 
 		roomId := logId.RoomId
 		existing, ok := idsToBlocks[roomId]
@@ -171,14 +349,13 @@ func (r *RollCollection) collectionToLongFormMap(collection map[bullet_stl.Colle
 	return idsToBlocks, nil
 }
 
-func (r *RollCollection) RollsForRoom(id RoomId) ([]model.LogEntry, error) {
-
-	res, err := r.Collection.AllItemsUnderPrefix(id.Id)
-	if err != nil || len(res) == 0 {
-		return nil, err
+// legacyRolls decodes rolls stored before claims, ordered by Seq.
+func (r *RollCollection) legacyRolls(id RoomId, legacy map[bullet_stl.CollectionId]bullet_stl.CollectionItem) ([]model.LogEntry, error) {
+	if len(legacy) == 0 {
+		return nil, nil
 	}
 
-	idMap, err := r.collectionToLongFormMap(res)
+	idMap, err := r.collectionToLongFormMap(legacy)
 	if err != nil {
 		return nil, err
 	}
@@ -198,12 +375,126 @@ func (r *RollCollection) RollsForRoom(id RoomId) ([]model.LogEntry, error) {
 	//sorted for top level first.
 	sortedItemLList := entries
 	sort.Slice(sortedItemLList, func(i, j int) bool {
-		return sortedItemLList[i].UnixMillis < sortedItemLList[j].UnixMillis
+		return sortedItemLList[i].Seq < sortedItemLList[j].Seq
 	})
-	return sortedItemLList, nil
+	// A revealed roll has a second, public copy under the same id; that one wins.
+	// Any other pair of rolls sharing an id means the log is corrupt, and
+	// silently dropping one of them would hide a roll.
+	deduped := sortedItemLList[:0]
+	for _, entry := range sortedItemLList {
+		if n := len(deduped); n > 0 && deduped[n-1].Seq == entry.Seq {
+			if !sameRoll(deduped[n-1], entry) {
+				return nil, fmt.Errorf("room %s has two different rolls with id %d", id.Id, entry.Seq)
+			}
+			if entry.Visibility == model.VisibilityPublic {
+				deduped[n-1] = entry
+			}
+			continue
+		}
+		deduped = append(deduped, entry)
+	}
+	return deduped, nil
 
 }
 
+// sameRoll reports whether a and b are copies of one roll, differing at most
+// in who can see it.
+func sameRoll(a, b model.LogEntry) bool {
+	a.Visibility, b.Visibility = model.VisibilityPublic, model.VisibilityPublic
+	return reflect.DeepEqual(a, b)
+}
+
+// RollsForRoom returns every roll in the room, oldest first. It reads the
+// whole room at once; pages of it should come from RecentRolls.
+func (r *RollCollection) RollsForRoom(id RoomId) ([]model.LogEntry, error) {
+	if err := r.migrate(id); err != nil {
+		return nil, err
+	}
+	res, err := r.Collection.AllItemsUnderPrefix(rollPrefix(id))
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	rolls, err := r.wonRolls(id, res)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]model.LogEntry, len(rolls))
+	for i, roll := range rolls {
+		entries[i] = roll.Entry
+	}
+	return entries, nil
+}
+
+// RevealRoll makes a secret or whispered roll public by writing a revealed copy
+// of it beside its claim, as items are never rewritten.
+func (r *RollCollection) RevealRoll(room RoomId, seq int64) (*model.LogEntry, error) {
+	if err := r.migrate(room); err != nil {
+		return nil, err
+	}
+	prefix := seqPrefix(room, seq)
+	items, err := r.Collection.AllItemsUnderPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	rolls, err := r.wonRolls(room, items)
+	if err != nil {
+		return nil, err
+	}
+	if len(rolls) == 0 {
+		return nil, store.ErrRollNotFound
+	}
+	roll := rolls[0]
+	entry := roll.Entry
+	if entry.Visibility == model.VisibilityPublic {
+		return &entry, nil
+	}
+	entry.Visibility = model.VisibilityPublic
+
+	now := time.Now()
+	encoded, err := r.Codec.Encode(entry)
+	if err != nil {
+		return nil, err
+	}
+	key := prefix + revealKind + ":" + roll.Token + ":" + TimeToMillisString(now)
+	if err := r.Collection.CreateItem(key, encoded, &now); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RecentRolls returns up to limit rolls older than before, newest first. It
+// reads the log a block of ids at a time, from the block holding the newest
+// roll wanted down, so a page costs a read or two whatever the room's size.
+func (r *RollCollection) RecentRolls(id RoomId, before int64, limit int) ([]model.LogEntry, error) {
+	if err := r.migrate(id); err != nil {
+		return nil, err
+	}
+	top, err := r.log.head(id)
+	if err != nil {
+		return nil, err
+	}
+	if before > 0 {
+		top = min(top, before-1)
+	}
+	page := make([]model.LogEntry, 0, limit)
+	for b := block(top); b >= block(FirstEntryId().IntValue+1) && len(page) < limit; b-- {
+		items, err := r.Collection.AllItemsUnderPrefix(blockPrefix(id, b))
+		if err != nil {
+			return nil, err
+		}
+		rolls, err := r.wonRolls(id, items)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(rolls) - 1; i >= 0 && len(page) < limit; i-- {
+			if rolls[i].Entry.Seq <= top {
+				page = append(page, rolls[i].Entry)
+			}
+		}
+	}
+	return page, nil
+}
+
 func TimeToMillisString(time time.Time) string {
 	millis := time.UnixMilli()
 	return strconv.FormatInt(millis, 10)
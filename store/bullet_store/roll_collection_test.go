@@ -0,0 +1,298 @@
+package bullet_store
+
+import (
+	"dice_room/model"
+	"dice_room/store"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bullet_stl "github.com/vixac/firbolg_clients/bullet/bullet_stl/containers"
+	ids "github.com/vixac/firbolg_clients/bullet/bullet_stl/ids"
+)
+
+// fakeCollection is an in-memory bullet collection that yields between reading
+// and writing, the way a round trip to bullet would, to give races room to
+// happen. It counts reads, and the most items any one read returned. The
+// stores reach it through the same adapters as a real collection.
+type fakeCollection struct {
+	// Collection is nil; the stores use only the methods below.
+	bullet_stl.Collection
+
+	mu      sync.Mutex
+	items   map[string]string
+	reads   int
+	largest int
+}
+
+func newFakeCollection() *fakeCollection {
+	return &fakeCollection{items: make(map[string]string)}
+}
+
+func (f *fakeCollection) AllItemsUnderPrefix(prefix string) (map[bullet_stl.CollectionId]bullet_stl.CollectionItem, error) {
+	f.mu.Lock()
+	out := make(map[bullet_stl.CollectionId]bullet_stl.CollectionItem)
+	for k, v := range f.items {
+		if strings.HasPrefix(k, prefix) {
+			out[bullet_stl.CollectionId{Key: k}] = bullet_stl.CollectionItem{Payload: v}
+		}
+	}
+	f.reads++
+	f.largest = max(f.largest, len(out))
+	f.mu.Unlock()
+	runtime.Gosched()
+	return out, nil
+}
+
+func (f *fakeCollection) CreateItemUnder(key string, payload string, created *time.Time) (*bullet_stl.CollectionId, error) {
+	runtime.Gosched()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[key] = payload
+	return &bullet_stl.CollectionId{Key: key}, nil
+}
+
+// write stores an item directly, as another writer would.
+func (f *fakeCollection) write(key, payload string) {
+	f.CreateItemUnder(key, payload, nil)
+}
+
+func TestAddRollConcurrentIdsAreUnique(t *testing.T) {
+	const rolls = 150
+	// Two collections on one bullet collection stand in for two processes.
+	items := newFakeCollection()
+	colls := []RollCollection{
+		newRollCollection(bulletRollItems{items}, &JSONCodec[model.LogEntry]{}),
+		newRollCollection(bulletRollItems{items}, &JSONCodec[model.LogEntry]{}),
+	}
+	room := RoomId{Id: "room1"}
+	other := RoomId{Id: "room10"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(colls)*rolls)
+	for c := range colls {
+		for i := 0; i < rolls; i++ {
+			for _, id := range []RoomId{room, other} {
+				wg.Add(1)
+				go func(coll *RollCollection, id RoomId, result int) {
+					defer wg.Done()
+					// Each roll is made for the id it claims, as a fair roll's nonce is.
+					_, err := coll.AddRollFor(id, func(seq int64) (model.LogEntry, error) {
+						return model.LogEntry{Result: result, Proof: &model.Proof{Nonce: int(seq)}}, nil
+					})
+					errs <- err
+				}(&colls[c], id, c*rolls+i)
+			}
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("AddRollFor: %v", err)
+		}
+	}
+
+	reader := newRollCollection(bulletRollItems{items}, &JSONCodec[model.LogEntry]{})
+	for _, id := range []RoomId{room, other} {
+		entries, err := reader.RollsForRoom(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs := make(map[int64]bool)
+		results := make(map[int]bool)
+		for _, e := range entries {
+			if seqs[e.Seq] {
+				t.Errorf("room %s: id %d used twice", id.Id, e.Seq)
+			}
+			if e.Proof == nil || int64(e.Proof.Nonce) != e.Seq {
+				t.Errorf("room %s: roll %d was made for another id: %+v", id.Id, e.Seq, e.Proof)
+			}
+			seqs[e.Seq] = true
+			results[e.Result] = true
+		}
+		if len(entries) != len(colls)*rolls || len(results) != len(colls)*rolls {
+			t.Errorf("room %s: got %d rolls with %d distinct results, want %d", id.Id, len(entries), len(results), len(colls)*rolls)
+		}
+	}
+}
+
+func TestRevealRollReplacesSecretCopy(t *testing.T) {
+	coll := newRollCollection(bulletRollItems{newFakeCollection()}, &JSONCodec[model.LogEntry]{})
+	room := RoomId{Id: "room1"}
+	secret := model.LogEntry{Result: 17, Visibility: model.VisibilityGM}
+	if err := coll.AddRoll(room, &model.LogEntry{Result: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.AddRoll(room, &secret); err != nil {
+		t.Fatal(err)
+	}
+	// A new millisecond, so the revealed copy gets a key of its own.
+	time.Sleep(2 * time.Millisecond)
+
+	revealed, err := coll.RevealRoll(room, secret.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revealed.Visibility != model.VisibilityPublic || revealed.Result != 17 || revealed.Seq != secret.Seq {
+		t.Errorf("RevealRoll returned %+v", revealed)
+	}
+	rolls, err := coll.RollsForRoom(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rolls) != 2 || rolls[1].Seq != secret.Seq || rolls[1].Visibility != model.VisibilityPublic {
+		t.Errorf("rolls after reveal = %+v, want the second one public", rolls)
+	}
+	if _, err := coll.RevealRoll(room, secret.Seq+1); err != store.ErrRollNotFound {
+		t.Errorf("revealing a missing roll: got %v, want ErrRollNotFound", err)
+	}
+}
+
+func TestRollsForRoomRejectsTwoWinnersOfOneId(t *testing.T) {
+	items := newFakeCollection()
+	coll := newRollCollection(bulletRollItems{items}, &JSONCodec[model.LogEntry]{})
+	room := RoomId{Id: "room1"}
+	first := model.LogEntry{User: "ann", Result: 4}
+	if err := coll.AddRoll(room, &first); err != nil {
+		t.Fatal(err)
+	}
+	// A claim that lost, or has not won yet, is not a roll.
+	prefix := seqPrefix(room, first.Seq)
+	items.write(prefix+claimKind+":other", `{"user":"bob","result":6}`)
+	if rolls, err := coll.RollsForRoom(room); err != nil || len(rolls) != 1 || rolls[0].User != "ann" {
+		t.Fatalf("rolls beside a lost claim = %+v, %v", rolls, err)
+	}
+	items.write(prefix+wonKind+":other", "")
+	if rolls, err := coll.RollsForRoom(room); err == nil {
+		t.Errorf("two winners of id %d gave %+v, want an error", first.Seq, rolls)
+	}
+}
+
+func TestLegacyRollsAreMigrated(t *testing.T) {
+	items := newFakeCollection()
+	room := RoomId{Id: "room1"}
+	codec := &JSONCodec[model.LogEntry]{}
+	writeLegacy := func(seq int64, entry model.LogEntry, at int64) {
+		entryId, _ := ids.NewBulletIdFromInt(seq)
+		key := LogId{RoomId: room, EntryId: *entryId, CreatedTime: time.UnixMilli(at)}
+		encoded, _ := codec.Encode(entry)
+		items.write(key.ToString(), encoded)
+	}
+	first := FirstEntryId().Next().IntValue
+	secret := model.LogEntry{User: "dm", Result: 17, Visibility: model.VisibilityGM}
+	revealed := secret
+	revealed.Visibility = model.VisibilityPublic
+	writeLegacy(first, model.LogEntry{User: "ann", Result: 3}, 1000)
+	writeLegacy(first+1, secret, 2000)
+	writeLegacy(first+1, revealed, 3000)
+
+	coll := newRollCollection(bulletRollItems{items}, codec)
+	check := func(coll RollCollection) {
+		t.Helper()
+		rolls, err := coll.RollsForRoom(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rolls) != 2 || rolls[0].Seq != first || rolls[0].User != "ann" ||
+			rolls[1].Seq != first+1 || rolls[1].Visibility != model.VisibilityPublic {
+			t.Errorf("migrated rolls = %+v", rolls)
+		}
+	}
+	check(coll)
+
+	// Migrating again, as a process that raced the first would, changes nothing.
+	keys := len(items.items)
+	delete(items.items, rollPrefix(room)+migratedKey)
+	check(newRollCollection(bulletRollItems{items}, codec))
+	if len(items.items) != keys {
+		t.Errorf("migrating again left %d items, want %d", len(items.items), keys)
+	}
+
+	next := model.LogEntry{Result: 5}
+	if err := coll.AddRoll(room, &next); err != nil {
+		t.Fatal(err)
+	}
+	if next.Seq != first+2 {
+		t.Errorf("first roll after migrating has id %d, want %d", next.Seq, first+2)
+	}
+
+	// Legacy rolls that differ are not a reveal, and are not merged.
+	broken := RoomId{Id: "room2"}
+	room = broken
+	writeLegacy(first, model.LogEntry{User: "ann", Result: 3}, 1000)
+	writeLegacy(first, model.LogEntry{User: "bob", Result: 6, Visibility: model.VisibilityPublic}, 2000)
+	if rolls, err := coll.RollsForRoom(broken); err == nil {
+		t.Errorf("two legacy rolls with id %d gave %+v, want an error", first, rolls)
+	}
+}
+
+func TestRecentRollsReadsOnlyThePage(t *testing.T) {
+	const rolls = 1000
+	items := newFakeCollection()
+	coll := newRollCollection(bulletRollItems{items}, &JSONCodec[model.LogEntry]{})
+	room := RoomId{Id: "room1"}
+	if page, err := coll.RecentRolls(room, 0, 10); err != nil || len(page) != 0 {
+		t.Fatalf("empty room gave %+v, %v", page, err)
+	}
+	for i := 0; i < rolls; i++ {
+		if err := coll.AddRoll(room, &model.LogEntry{Result: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reads := func(coll RollCollection, before int64, limit int) []model.LogEntry {
+		t.Helper()
+		items.reads, items.largest = 0, 0
+		page, err := coll.RecentRolls(room, before, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if items.largest > 2*blockSize {
+			t.Errorf("a read returned %d items, more than a block holds", items.largest)
+		}
+		return page
+	}
+
+	// The writer knows where the newest roll is.
+	page := reads(coll, 0, 10)
+	if items.reads > 2 {
+		t.Errorf("newest page took %d reads, want at most 2", items.reads)
+	}
+	if len(page) != 10 || page[0].Result != rolls-1 || page[9].Result != rolls-10 {
+		t.Errorf("newest page = %+v", page)
+	}
+
+	// Another process has to find it, but not by reading everything.
+	cold := newRollCollection(bulletRollItems{items}, &JSONCodec[model.LogEntry]{})
+	if page := reads(cold, 0, 1); len(page) != 1 || page[0].Result != rolls-1 {
+		t.Errorf("newest roll from a new collection = %+v", page)
+	}
+	if items.reads > 12 {
+		t.Errorf("finding the newest roll took %d reads", items.reads)
+	}
+
+	// Paging back through the room visits every roll once, newest first.
+	var before int64
+	for want := rolls - 1; want >= 0; {
+		page := reads(coll, before, 30)
+		if len(page) == 0 || items.reads > 3 {
+			t.Fatalf("page before %d: %d rolls in %d reads", before, len(page), items.reads)
+		}
+		for _, e := range page {
+			if e.Result != want {
+				t.Fatalf("got roll %d, want %d", e.Result, want)
+			}
+			want--
+		}
+		before = page[len(page)-1].Seq
+	}
+	if page := reads(coll, before, 30); len(page) != 0 {
+		t.Errorf("page before the first roll = %+v", page)
+	}
+	if page := reads(coll, 1<<40, 1); len(page) != 1 || page[0].Result != rolls-1 || items.reads > 2 {
+		t.Errorf("page before a far future id = %+v in %d reads", page, items.reads)
+	}
+}
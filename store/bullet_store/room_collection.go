@@ -1,6 +1,7 @@
 package bullet_store
 
 import (
+	"dice_room/store"
 	"errors"
 	"strconv"
 	"time"
@@ -15,8 +16,10 @@ type RoomCollection struct {
 }
 
 type RoomInfo struct {
-	Id   string
-	Name string
+	Id         string
+	Name       string
+	GMKey      string `json:",omitempty"`
+	Passphrase string `json:",omitempty"`
 }
 type RoomId struct {
 	Id string
@@ -34,15 +37,17 @@ func NewRoomCollection(bucketId int32, client bullet_interface.BulletClientInter
 }
 
 // VX:TODO with this implementation room ids need to be unique.
-func (r *RoomCollection) CreateRoom(name string) (*RoomId, error) {
+func (r *RoomCollection) CreateRoom(name, gmKey, passphrase string) (*RoomId, error) {
 	id := strconv.FormatInt(time.Now().UnixNano(), 36)
 	if name == "" {
 		name = id
 	}
 	now := time.Now()
 	room := RoomInfo{
-		Id:   id,
-		Name: name,
+		Id:         id,
+		Name:       name,
+		GMKey:      gmKey,
+		Passphrase: passphrase,
 	}
 	encoded, err := r.Codec.Encode(room)
 	if err != nil {
@@ -64,6 +69,9 @@ func (r *RoomCollection) GetRoom(id RoomId) (*RoomInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(items) == 0 {
+		return nil, store.ErrRoomNotFound
+	}
 	if len(items) != 1 {
 		return nil, errors.New("wrong number of items for room")
 	}
@@ -79,5 +87,5 @@ func (r *RoomCollection) GetRoom(id RoomId) (*RoomInfo, error) {
 		}
 		return &info, err
 	}
-	return nil, errors.New("Room not found")
+	return nil, store.ErrRoomNotFound
 }
@@ -0,0 +1,89 @@
+package bullet_store
+
+import (
+	"dice_room/model"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vixac/firbolg_clients/bullet/bullet_interface"
+	bullet_stl "github.com/vixac/firbolg_clients/bullet/bullet_stl/containers"
+)
+
+// SeedCollection stores each room's provably fair server seeds under
+// roomId:hash:createdMillis. Revealing a seed writes a second, revealed copy
+// rather than rewriting the first, and a revealed copy always wins.
+type SeedCollection struct {
+	Codec      Codec[model.ServerSeed]
+	Collection bullet_stl.Collection
+}
+
+func NewSeedCollection(bucketId int32, client bullet_interface.BulletClientInterface, codec Codec[model.ServerSeed]) SeedCollection {
+	coll := bullet_stl.NewBulletCollection(bucketId, client, client)
+	return SeedCollection{
+		Collection: coll,
+		Codec:      codec,
+	}
+}
+
+func (s *SeedCollection) SaveSeed(room RoomId, seed model.ServerSeed) error {
+	now := time.Now()
+	encoded, err := s.Codec.Encode(seed)
+	if err != nil {
+		return err
+	}
+	key := room.Id + ":" + seed.Hash + ":" + TimeToMillisString(now)
+	_, err = s.Collection.CreateItemUnder(key, encoded, &now)
+	return err
+}
+
+// SeedsForRoom returns the room's seeds, oldest first.
+func (s *SeedCollection) SeedsForRoom(room RoomId) ([]model.ServerSeed, error) {
+	items, err := s.Collection.AllItemsUnderPrefix(room.Id + ":")
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	byHash := make(map[string]model.ServerSeed)
+	for k, v := range items {
+		split := strings.Split(k.Key, ":")
+		if len(split) != 3 || split[0] != room.Id {
+			return nil, errors.New("invalid seed key")
+		}
+		var seed model.ServerSeed
+		if err := s.Codec.Decode(v.Payload, &seed); err != nil {
+			return nil, err
+		}
+		if _, ok := byHash[seed.Hash]; !ok || seed.Revealed {
+			byHash[seed.Hash] = seed
+		}
+	}
+
+	seeds := make([]model.ServerSeed, 0, len(byHash))
+	for _, seed := range byHash {
+		seeds = append(seeds, seed)
+	}
+	sort.Slice(seeds, func(i, j int) bool {
+		return seeds[i].Created < seeds[j].Created
+	})
+	return seeds, nil
+}
+
+// RotateSeed reveals every seed the room has drawn from and saves next as the current one.
+func (s *SeedCollection) RotateSeed(room RoomId, next model.ServerSeed) error {
+	seeds, err := s.SeedsForRoom(room)
+	if err != nil {
+		return err
+	}
+	for _, seed := range seeds {
+		if seed.Revealed {
+			continue
+		}
+		seed.Revealed = true
+		if err := s.SaveSeed(room, seed); err != nil {
+			return err
+		}
+	}
+	return s.SaveSeed(room, next)
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"cmp"
 	"dice_room/model"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
@@ -11,18 +13,37 @@ import (
 type MemoryStore struct {
 	mu    sync.Mutex
 	rooms map[string]*model.Room
+	logs  map[string][]model.LogEntry
+	bans  map[string][]model.Ban
+	// events holds each room's newest outbox events, numbered by lastEvent.
+	events    map[string][]OutboxEvent
+	lastEvent int64
+	// ips holds each room's players' last addresses by player id.
+	ips map[string]map[string]string
 }
 
+// maxMemoryOutbox is how many events MemoryStore keeps in a room's outbox.
+const maxMemoryOutbox = 1000
+
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{rooms: make(map[string]*model.Room)}
+	return &MemoryStore{
+		rooms:  make(map[string]*model.Room),
+		logs:   make(map[string][]model.LogEntry),
+		bans:   make(map[string][]model.Ban),
+		events: make(map[string][]OutboxEvent),
+		ips:    make(map[string]map[string]string),
+	}
 }
 
-func (s *MemoryStore) CreateRoom(name string) (*model.Room, error) {
+func (s *MemoryStore) CreateRoom(name string, seed model.ServerSeed, gmKey, passphrase string) (*model.Room, error) {
 	id := strconv.FormatInt(time.Now().UnixNano(), 36)
 	if name == "" {
 		name = id
 	}
-	room := &model.Room{Id: id, RoomName: name}
+	room := &model.Room{Id: id, RoomName: name, GMKey: gmKey, Passphrase: passphrase}
+	if seed.Hash != "" {
+		room.Seeds = []model.ServerSeed{seed}
+	}
 	s.mu.Lock()
 	s.rooms[id] = room
 	s.mu.Unlock()
@@ -39,13 +60,192 @@ func (s *MemoryStore) GetRoom(id string) (*model.Room, error) {
 	return room, nil
 }
 
-func (s *MemoryStore) AddEntry(roomID string, entry model.LogEntry) error {
+func (s *MemoryStore) AddEntry(roomID string, entry *model.LogEntry) error {
+	added, err := s.AddEntryFor(roomID, func(int64) (model.LogEntry, error) {
+		return *entry, nil
+	})
+	if err != nil {
+		return err
+	}
+	entry.Seq = added.Seq
+	return nil
+}
+
+func (s *MemoryStore) AddEntryFor(roomID string, roll func(seq int64) (model.LogEntry, error)) (*model.LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[roomID]; !ok {
+		return nil, ErrRoomNotFound
+	}
+	log := s.logs[roomID]
+	seq := int64(len(log) + 1)
+	entry, err := roll(seq)
+	if err != nil {
+		return nil, err
+	}
+	entry.Seq = seq
+	s.logs[roomID] = append(log, entry)
+	return &entry, nil
+}
+
+func (s *MemoryStore) RevealRoll(roomID string, seq int64) (*model.LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[roomID]; !ok {
+		return nil, ErrRoomNotFound
+	}
+	log := s.logs[roomID]
+	if seq < 1 || seq > int64(len(log)) {
+		return nil, ErrRollNotFound
+	}
+	log[seq-1].Visibility = model.VisibilityPublic
+	entry := log[seq-1]
+	return &entry, nil
+}
+
+func (s *MemoryStore) RecentRolls(roomID string, before int64, limit int) ([]model.LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[roomID]; !ok {
+		return nil, ErrRoomNotFound
+	}
+	log := s.logs[roomID]
+	// Seq is the 1-based position in the log, so the cursor indexes it directly.
+	end := len(log)
+	if before > 0 {
+		end = min(end, int(before-1))
+	}
+	var page []model.LogEntry
+	for i := end - 1; i >= 0 && len(page) < limit; i-- {
+		page = append(page, log[i])
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) SaveCustomDie(roomID string, die model.CustomDie) error {
+	room, err := s.GetRoom(roomID)
+	if err != nil {
+		return err
+	}
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+	for i := range room.CustomDice {
+		if room.CustomDice[i].Name == die.Name {
+			room.CustomDice[i] = die
+			return nil
+		}
+	}
+	room.CustomDice = append(room.CustomDice, die)
+	return nil
+}
+
+func (s *MemoryStore) RotateSeed(roomID string, next model.ServerSeed) error {
 	room, err := s.GetRoom(roomID)
 	if err != nil {
 		return err
 	}
 	room.Lock.Lock()
-	room.Log = append(room.Log, entry)
-	room.Lock.Unlock()
+	defer room.Lock.Unlock()
+	for i := range room.Seeds {
+		room.Seeds[i].Revealed = true
+	}
+	room.Seeds = append(room.Seeds, next)
+	return nil
+}
+
+func (s *MemoryStore) AddBan(roomID string, ban model.Ban) error {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[roomID] = append(s.bans[roomID], ban)
+	return nil
+}
+
+func (s *MemoryStore) Bans(roomID string) ([]model.Ban, error) {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]model.Ban(nil), s.bans[roomID]...), nil
+}
+
+func (s *MemoryStore) LiftBan(roomID, banID string) error {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bans := s.bans[roomID]
+	for i := range bans {
+		if bans[i].ID == banID {
+			s.bans[roomID] = append(bans[:i:i], bans[i+1:]...)
+			return nil
+		}
+	}
+	return ErrBanNotFound
+}
+
+func (s *MemoryStore) AppendEvent(roomID, payload string) (int64, error) {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastEvent++
+	events := append(s.events[roomID], OutboxEvent{ID: s.lastEvent, Payload: payload})
+	if len(events) > maxMemoryOutbox {
+		events = append([]OutboxEvent(nil), events[len(events)-maxMemoryOutbox/2:]...)
+	}
+	s.events[roomID] = events
+	return s.lastEvent, nil
+}
+
+func (s *MemoryStore) EventsAfter(roomID string, after int64, limit int) ([]OutboxEvent, error) {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.events[roomID]
+	i, _ := slices.BinarySearchFunc(events, after+1, func(e OutboxEvent, id int64) int {
+		return cmp.Compare(e.ID, id)
+	})
+	return append([]OutboxEvent(nil), events[i:min(i+limit, len(events))]...), nil
+}
+
+func (s *MemoryStore) LastEventID(roomID string) (int64, error) {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if events := s.events[roomID]; len(events) > 0 {
+		return events[len(events)-1].ID, nil
+	}
+	return 0, nil
+}
+
+func (s *MemoryStore) SetPlayerIP(roomID, playerID, ip string) error {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ips[roomID] == nil {
+		s.ips[roomID] = make(map[string]string)
+	}
+	s.ips[roomID][playerID] = ip
 	return nil
 }
+
+func (s *MemoryStore) PlayerIP(roomID, playerID string) (string, error) {
+	if _, err := s.GetRoom(roomID); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ips[roomID][playerID], nil
+}
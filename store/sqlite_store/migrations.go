@@ -0,0 +1,107 @@
+package sqlite_store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order, each in its own transaction, and recorded in
+// schema_migrations. Never edit one that has shipped; append a new one instead.
+var migrations = []string{
+	// 1: rooms and their roll log.
+	`CREATE TABLE rooms (
+		id             TEXT PRIMARY KEY,
+		name           TEXT NOT NULL,
+		created_millis INTEGER NOT NULL
+	);
+	CREATE TABLE entries (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id     TEXT NOT NULL REFERENCES rooms(id),
+		unix_millis INTEGER NOT NULL,
+		payload     TEXT NOT NULL
+	);
+	CREATE INDEX entries_room_time ON entries(room_id, unix_millis);`,
+
+	// 2: per-room custom dice and provably fair seeds.
+	`CREATE TABLE custom_dice (
+		room_id TEXT NOT NULL REFERENCES rooms(id),
+		name    TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		PRIMARY KEY (room_id, name)
+	);
+	CREATE TABLE seeds (
+		room_id        TEXT NOT NULL REFERENCES rooms(id),
+		hash           TEXT NOT NULL,
+		seed           TEXT NOT NULL,
+		revealed       INTEGER NOT NULL DEFAULT 0,
+		created_millis INTEGER NOT NULL,
+		PRIMARY KEY (room_id, hash)
+	);
+	CREATE INDEX seeds_room_time ON seeds(room_id, created_millis);`,
+
+	// 3: newest-first paging of a room's rolls by id.
+	`CREATE INDEX entries_room_id ON entries(room_id, id);`,
+
+	// 4: the hash of the room GM's key.
+	`ALTER TABLE rooms ADD COLUMN gm_key TEXT NOT NULL DEFAULT '';`,
+
+	// 5: the hashed passphrase of rooms that need one.
+	`ALTER TABLE rooms ADD COLUMN passphrase TEXT NOT NULL DEFAULT '';`,
+
+	// 6: players banned or kicked from a room.
+	`CREATE TABLE bans (
+		room_id        TEXT NOT NULL REFERENCES rooms(id),
+		id             TEXT NOT NULL,
+		created_millis INTEGER NOT NULL,
+		payload        TEXT NOT NULL,
+		PRIMARY KEY (room_id, id)
+	);`,
+
+	// 7: each room's outbox of live events, read by the other instances.
+	`CREATE TABLE events (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id        TEXT NOT NULL REFERENCES rooms(id),
+		created_millis INTEGER NOT NULL,
+		payload        TEXT NOT NULL
+	);
+	CREATE INDEX events_room_id ON events(room_id, id);
+	CREATE INDEX events_time ON events(created_millis);`,
+
+	// 8: the address each player last connected to a room from.
+	`CREATE TABLE player_ips (
+		room_id     TEXT NOT NULL REFERENCES rooms(id),
+		player_id   TEXT NOT NULL,
+		ip          TEXT NOT NULL,
+		seen_millis INTEGER NOT NULL,
+		PRIMARY KEY (room_id, player_id)
+	);`,
+}
+
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,461 @@
+package sqlite_store
+
+import (
+	"database/sql"
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SqliteStore is a single-file implementation of store.Store for small
+// self-hosted deployments. Entries and custom dice are stored as JSON payloads
+// so new LogEntry fields need no migration.
+type SqliteStore struct {
+	db *sql.DB
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewSqliteStore opens (creating if needed) the database at path and brings
+// its schema up to date.
+func NewSqliteStore(path string) (*SqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &SqliteStore{db: db, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.sweepEvents()
+	return s, nil
+}
+
+func (s *SqliteStore) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+	return s.db.Close()
+}
+
+func (s *SqliteStore) CreateRoom(name string, seed model.ServerSeed, gmKey, passphrase string) (*model.Room, error) {
+	now := time.Now()
+	id := strconv.FormatInt(now.UnixNano(), 36)
+	if name == "" {
+		name = id
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO rooms (id, name, created_millis, gm_key, passphrase) VALUES (?, ?, ?, ?, ?)`,
+		id, name, now.UnixMilli(), gmKey, passphrase); err != nil {
+		return nil, err
+	}
+	room := &model.Room{Id: id, RoomName: name, GMKey: gmKey, Passphrase: passphrase}
+	if seed.Hash != "" {
+		if err := insertSeed(tx, id, seed); err != nil {
+			return nil, err
+		}
+		room.Seeds = []model.ServerSeed{seed}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func insertSeed(tx *sql.Tx, roomID string, seed model.ServerSeed) error {
+	_, err := tx.Exec(`INSERT INTO seeds (room_id, hash, seed, revealed, created_millis) VALUES (?, ?, ?, ?, ?)`,
+		roomID, seed.Hash, seed.Seed, seed.Revealed, seed.Created)
+	return err
+}
+
+func (s *SqliteStore) GetRoom(id string) (*model.Room, error) {
+	room := model.Room{Id: id}
+	err := s.db.QueryRow(`SELECT name, gm_key, passphrase FROM rooms WHERE id = ?`, id).
+		Scan(&room.RoomName, &room.GMKey, &room.Passphrase)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if room.CustomDice, err = s.customDice(id); err != nil {
+		return nil, err
+	}
+	if room.Seeds, err = s.seeds(id); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// RecentRolls pages by the entries primary key, which doubles as the roll's Seq.
+func (s *SqliteStore) RecentRolls(roomID string, before int64, limit int) ([]model.LogEntry, error) {
+	if err := roomExists(s.db, roomID); err != nil {
+		return nil, err
+	}
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	rows, err := s.db.Query(`SELECT id, payload FROM entries WHERE room_id = ? AND id < ? ORDER BY id DESC LIMIT ?`, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []model.LogEntry
+	for rows.Next() {
+		var seq int64
+		var payload string
+		if err := rows.Scan(&seq, &payload); err != nil {
+			return nil, err
+		}
+		var entry model.LogEntry
+		if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+			return nil, err
+		}
+		entry.Seq = seq
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SqliteStore) customDice(roomID string) ([]model.CustomDie, error) {
+	rows, err := s.db.Query(`SELECT payload FROM custom_dice WHERE room_id = ? ORDER BY name`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dice []model.CustomDie
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var die model.CustomDie
+		if err := json.Unmarshal([]byte(payload), &die); err != nil {
+			return nil, err
+		}
+		dice = append(dice, die)
+	}
+	return dice, rows.Err()
+}
+
+func (s *SqliteStore) seeds(roomID string) ([]model.ServerSeed, error) {
+	rows, err := s.db.Query(`SELECT hash, seed, revealed, created_millis FROM seeds WHERE room_id = ? ORDER BY created_millis`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var seeds []model.ServerSeed
+	for rows.Next() {
+		var seed model.ServerSeed
+		if err := rows.Scan(&seed.Hash, &seed.Seed, &seed.Revealed, &seed.Created); err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, rows.Err()
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// roomExists turns a missing room into store.ErrRoomNotFound before a write,
+// rather than surfacing a foreign key failure.
+func roomExists(q queryRower, roomID string) error {
+	var one int
+	err := q.QueryRow(`SELECT 1 FROM rooms WHERE id = ?`, roomID).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return store.ErrRoomNotFound
+	}
+	return err
+}
+
+func (s *SqliteStore) AddEntry(roomID string, entry *model.LogEntry) error {
+	if err := roomExists(s.db, roomID); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO entries (room_id, unix_millis, payload) VALUES (?, ?, ?)`, roomID, entry.UnixMillis, string(payload))
+	if err != nil {
+		return err
+	}
+	entry.Seq, err = res.LastInsertId()
+	return err
+}
+
+// AddEntryFor inserts a placeholder row to be given the roll's id, and fills
+// it in before the insert is committed.
+func (s *SqliteStore) AddEntryFor(roomID string, roll func(seq int64) (model.LogEntry, error)) (*model.LogEntry, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := roomExists(tx, roomID); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(`INSERT INTO entries (room_id, unix_millis, payload) VALUES (?, 0, '{}')`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := roll(seq)
+	if err != nil {
+		return nil, err
+	}
+	entry.Seq = seq
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE entries SET unix_millis = ?, payload = ? WHERE id = ?`, entry.UnixMillis, string(payload), seq); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RevealRoll rewrites the roll's payload, which is where Visibility lives.
+func (s *SqliteStore) RevealRoll(roomID string, seq int64) (*model.LogEntry, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := roomExists(tx, roomID); err != nil {
+		return nil, err
+	}
+	var payload string
+	err = tx.QueryRow(`SELECT payload FROM entries WHERE room_id = ? AND id = ?`, roomID, seq).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrRollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry model.LogEntry
+	if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+		return nil, err
+	}
+	entry.Seq = seq
+	if entry.Visibility == model.VisibilityPublic {
+		return &entry, nil
+	}
+	entry.Visibility = model.VisibilityPublic
+	updated, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE entries SET payload = ? WHERE id = ?`, string(updated), seq); err != nil {
+		return nil, err
+	}
+	return &entry, tx.Commit()
+}
+
+func (s *SqliteStore) SaveCustomDie(roomID string, die model.CustomDie) error {
+	if err := roomExists(s.db, roomID); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(die)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO custom_dice (room_id, name, payload) VALUES (?, ?, ?)
+		ON CONFLICT (room_id, name) DO UPDATE SET payload = excluded.payload`, roomID, die.Name, string(payload))
+	return err
+}
+
+func (s *SqliteStore) RotateSeed(roomID string, next model.ServerSeed) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := roomExists(tx, roomID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE seeds SET revealed = 1 WHERE room_id = ?`, roomID); err != nil {
+		return err
+	}
+	if err := insertSeed(tx, roomID, next); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) AddBan(roomID string, ban model.Ban) error {
+	if err := roomExists(s.db, roomID); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO bans (room_id, id, created_millis, payload) VALUES (?, ?, ?, ?)`,
+		roomID, ban.ID, ban.Created, string(payload))
+	return err
+}
+
+func (s *SqliteStore) Bans(roomID string) ([]model.Ban, error) {
+	if err := roomExists(s.db, roomID); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT payload FROM bans WHERE room_id = ? ORDER BY created_millis, id`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bans []model.Ban
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var ban model.Ban
+		if err := json.Unmarshal([]byte(payload), &ban); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+func (s *SqliteStore) LiftBan(roomID, banID string) error {
+	if err := roomExists(s.db, roomID); err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`DELETE FROM bans WHERE room_id = ? AND id = ?`, roomID, banID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return store.ErrBanNotFound
+	}
+	return nil
+}
+
+const (
+	// outboxRetention is how long events are kept in a room's outbox.
+	// Instances poll it every few seconds, so anything older has been read.
+	outboxRetention = 10 * time.Minute
+	// outboxSweep is how often events older than outboxRetention are dropped.
+	outboxSweep = time.Minute
+)
+
+// sweepEvents drops old outbox events every outboxSweep until Close.
+func (s *SqliteStore) sweepEvents() {
+	defer close(s.done)
+	ticker := time.NewTicker(outboxSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := s.dropEventsBefore(now.Add(-outboxRetention)); err != nil {
+				log.Printf("sqlite: drop old outbox events: %v", err)
+			}
+		}
+	}
+}
+
+// dropEventsBefore drops every room's outbox events created before cutoff.
+func (s *SqliteStore) dropEventsBefore(cutoff time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM events WHERE created_millis < ?`, cutoff.UnixMilli())
+	return err
+}
+
+// AppendEvent relies on writes being serialised, so ids are committed in order.
+func (s *SqliteStore) AppendEvent(roomID, payload string) (int64, error) {
+	if err := roomExists(s.db, roomID); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	res, err := s.db.Exec(`INSERT INTO events (room_id, created_millis, payload) VALUES (?, ?, ?)`,
+		roomID, now.UnixMilli(), payload)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SqliteStore) EventsAfter(roomID string, after int64, limit int) ([]store.OutboxEvent, error) {
+	if err := roomExists(s.db, roomID); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT id, payload FROM events WHERE room_id = ? AND id > ? ORDER BY id LIMIT ?`,
+		roomID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []store.OutboxEvent
+	for rows.Next() {
+		var ev store.OutboxEvent
+		if err := rows.Scan(&ev.ID, &ev.Payload); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (s *SqliteStore) LastEventID(roomID string) (int64, error) {
+	if err := roomExists(s.db, roomID); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM events WHERE room_id = ?`, roomID).Scan(&id)
+	return id, err
+}
+
+func (s *SqliteStore) SetPlayerIP(roomID, playerID, ip string) error {
+	if err := roomExists(s.db, roomID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO player_ips (room_id, player_id, ip, seen_millis) VALUES (?, ?, ?, ?)
+		ON CONFLICT (room_id, player_id) DO UPDATE SET ip = excluded.ip, seen_millis = excluded.seen_millis`,
+		roomID, playerID, ip, time.Now().UnixMilli())
+	return err
+}
+
+func (s *SqliteStore) PlayerIP(roomID, playerID string) (string, error) {
+	if err := roomExists(s.db, roomID); err != nil {
+		return "", err
+	}
+	var ip string
+	err := s.db.QueryRow(`SELECT ip FROM player_ips WHERE room_id = ? AND player_id = ?`, roomID, playerID).Scan(&ip)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return ip, err
+}
@@ -0,0 +1,382 @@
+package sqlite_store
+
+import (
+	"database/sql"
+	"dice_room/model"
+	"dice_room/store"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T) (*SqliteStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dice.db")
+	st, err := NewSqliteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st, path
+}
+
+func testSeed(hash string, created int64) model.ServerSeed {
+	return model.ServerSeed{Hash: hash, Seed: "seed-" + hash, Created: created}
+}
+
+func TestMigrationsRunFromEmptyAndAgain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dice.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	version := func() int {
+		var v, n int
+		if err := db.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&v, &n); err != nil {
+			t.Fatal(err)
+		}
+		if v != n {
+			t.Fatalf("schema_migrations has %d rows up to version %d", n, v)
+		}
+		return v
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("from empty: %v", err)
+	}
+	if v := version(); v != len(migrations) {
+		t.Fatalf("version %d after migrating, want %d", v, len(migrations))
+	}
+	if err := migrate(db); err != nil {
+		t.Fatalf("again: %v", err)
+	}
+	if v := version(); v != len(migrations) {
+		t.Fatalf("version %d after migrating again, want %d", v, len(migrations))
+	}
+
+	// Reopening the migrated file keeps what was stored.
+	st, err := NewSqliteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := st.CreateRoom("kept", testSeed("h1", 1), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	st, err = NewSqliteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if got, err := st.GetRoom(room.Id); err != nil || got.RoomName != "kept" {
+		t.Fatalf("room after reopening = %+v, %v", got, err)
+	}
+}
+
+func TestRoomAndEntriesRoundTrip(t *testing.T) {
+	st, _ := openStore(t)
+	created, err := st.CreateRoom("Crypt", testSeed("h1", 10), "gm-hash", "pass-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := st.GetRoom(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.RoomName != "Crypt" || room.GMKey != "gm-hash" || room.Passphrase != "pass-hash" ||
+		!reflect.DeepEqual(room.Seeds, []model.ServerSeed{testSeed("h1", 10)}) || room.CustomDice != nil {
+		t.Errorf("room = %+v", room)
+	}
+	unnamed, err := st.CreateRoom("", testSeed("h2", 10), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unnamed.RoomName != unnamed.Id {
+		t.Errorf("unnamed room is called %q, want its id %q", unnamed.RoomName, unnamed.Id)
+	}
+
+	entry := model.LogEntry{
+		User:       "ann",
+		PlayerID:   "p1",
+		Visibility: model.VisibilityWhisper,
+		Dice:       "d6",
+		Expression: "2d6kh1",
+		Result:     5,
+		Groups: []model.DiceGroup{{Notation: "2d6kh1", Die: "d6", Sides: 6, Total: 5,
+			Dice: []model.Die{{Value: 2, Dropped: true}, {Value: 5}}}},
+		Pool:       &model.PoolOutcome{Successes: 1},
+		Proof:      &model.Proof{SeedHash: "h1", ClientSeed: "c", Nonce: 3, Digest: "d"},
+		Desc:       "sneak",
+		Time:       "12:00:00",
+		UnixMillis: 1234,
+	}
+	if err := st.AddEntry(created.Id, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Seq == 0 {
+		t.Fatal("AddEntry did not set Seq")
+	}
+	got, err := st.RecentRolls(created.Id, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], entry) {
+		t.Errorf("stored entry = %+v, want %+v", got, entry)
+	}
+}
+
+func TestMissingRoom(t *testing.T) {
+	st, _ := openStore(t)
+	for name, err := range map[string]error{
+		"GetRoom":       func() error { _, err := st.GetRoom("nope"); return err }(),
+		"AddEntry":      st.AddEntry("nope", &model.LogEntry{}),
+		"RecentRolls":   func() error { _, err := st.RecentRolls("nope", 0, 10); return err }(),
+		"RevealRoll":    func() error { _, err := st.RevealRoll("nope", 1); return err }(),
+		"SaveCustomDie": st.SaveCustomDie("nope", model.CustomDie{Name: "x"}),
+		"RotateSeed":    st.RotateSeed("nope", testSeed("h", 1)),
+		"AddBan":        st.AddBan("nope", model.Ban{ID: "b"}),
+		"Bans":          func() error { _, err := st.Bans("nope"); return err }(),
+		"LiftBan":       st.LiftBan("nope", "b"),
+		"AppendEvent":   func() error { _, err := st.AppendEvent("nope", "{}"); return err }(),
+		"EventsAfter":   func() error { _, err := st.EventsAfter("nope", 0, 10); return err }(),
+		"LastEventID":   func() error { _, err := st.LastEventID("nope"); return err }(),
+		"SetPlayerIP":   st.SetPlayerIP("nope", "p", "203.0.113.7"),
+		"PlayerIP":      func() error { _, err := st.PlayerIP("nope", "p"); return err }(),
+	} {
+		if !errors.Is(err, store.ErrRoomNotFound) {
+			t.Errorf("%s: err = %v, want ErrRoomNotFound", name, err)
+		}
+	}
+}
+
+func TestRecentRollsPagesNewestFirst(t *testing.T) {
+	st, _ := openStore(t)
+	room, _ := st.CreateRoom("a", testSeed("h1", 1), "", "")
+	other, _ := st.CreateRoom("b", testSeed("h2", 1), "", "")
+	var seqs []int64
+	for i := 1; i <= 5; i++ {
+		e := model.LogEntry{Result: i, UnixMillis: int64(100 - i)}
+		if err := st.AddEntry(room.Id, &e); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, e.Seq)
+		st.AddEntry(other.Id, &model.LogEntry{Result: -i})
+	}
+
+	var results []int
+	var before int64
+	for pages := 0; ; pages++ {
+		page, err := st.RecentRolls(room.Id, before, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			if pages != 3 {
+				t.Errorf("%d pages, want 3", pages)
+			}
+			break
+		}
+		for _, e := range page {
+			results = append(results, e.Result)
+		}
+		before = page[len(page)-1].Seq
+	}
+	// Newest first by Seq, not by the time the browser reported.
+	if !reflect.DeepEqual(results, []int{5, 4, 3, 2, 1}) {
+		t.Errorf("results = %v, want [5 4 3 2 1]", results)
+	}
+	if page, _ := st.RecentRolls(room.Id, seqs[2], 10); len(page) != 2 || page[0].Seq != seqs[1] {
+		t.Errorf("rolls before %d = %+v, want the two before it", seqs[2], page)
+	}
+}
+
+func TestAddEntryForRollsForTheEntrysSeq(t *testing.T) {
+	st, _ := openStore(t)
+	room, _ := st.CreateRoom("a", testSeed("h1", 1), "", "")
+	added, err := st.AddEntryFor(room.Id, func(seq int64) (model.LogEntry, error) {
+		return model.LogEntry{Result: int(seq), UnixMillis: 7}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Seq == 0 || added.Result != int(added.Seq) {
+		t.Errorf("added = %+v, want a roll made for its own Seq", added)
+	}
+
+	failed := errors.New("bad roll")
+	if _, err := st.AddEntryFor(room.Id, func(int64) (model.LogEntry, error) {
+		return model.LogEntry{}, failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("failed roll: err = %v, want %v", err, failed)
+	}
+	if rolls, _ := st.RecentRolls(room.Id, 0, 10); len(rolls) != 1 || !reflect.DeepEqual(rolls[0], *added) {
+		t.Errorf("rolls = %+v, want only %+v", rolls, *added)
+	}
+}
+
+func TestRevealRoll(t *testing.T) {
+	st, path := openStore(t)
+	room, _ := st.CreateRoom("a", testSeed("h1", 1), "", "")
+	other, _ := st.CreateRoom("b", testSeed("h2", 1), "", "")
+	secret := model.LogEntry{User: "dm", Result: 17, Visibility: model.VisibilityGM}
+	st.AddEntry(room.Id, &secret)
+
+	revealed, err := st.RevealRoll(room.Id, secret.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revealed.Visibility != model.VisibilityPublic || revealed.Result != 17 || revealed.Seq != secret.Seq {
+		t.Errorf("revealed = %+v", revealed)
+	}
+	if _, err := st.RevealRoll(room.Id, secret.Seq); err != nil {
+		t.Errorf("revealing twice: %v", err)
+	}
+	if _, err := st.RevealRoll(other.Id, secret.Seq); !errors.Is(err, store.ErrRollNotFound) {
+		t.Errorf("revealing another room's roll: err = %v, want ErrRollNotFound", err)
+	}
+
+	st.Close()
+	st, err = NewSqliteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if page, _ := st.RecentRolls(room.Id, 0, 1); len(page) != 1 || page[0].Visibility != model.VisibilityPublic {
+		t.Errorf("stored roll after reveal = %+v", page)
+	}
+}
+
+func TestBans(t *testing.T) {
+	st, _ := openStore(t)
+	room, _ := st.CreateRoom("a", testSeed("h1", 1), "", "")
+	other, _ := st.CreateRoom("b", testSeed("h2", 1), "", "")
+	second := model.Ban{ID: "b2", PlayerID: "p2", Name: "bob", Created: 20}
+	first := model.Ban{ID: "b1", PlayerID: "p1", IP: "203.0.113.7", Name: "ann", Kick: true, Created: 10}
+	for _, b := range []model.Ban{second, first} {
+		if err := st.AddBan(room.Id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bans, err := st.Bans(room.Id); err != nil || !reflect.DeepEqual(bans, []model.Ban{first, second}) {
+		t.Errorf("bans = %+v, %v, want oldest first", bans, err)
+	}
+	if bans, _ := st.Bans(other.Id); len(bans) != 0 {
+		t.Errorf("other room's bans = %+v", bans)
+	}
+
+	if err := st.LiftBan(other.Id, "b1"); !errors.Is(err, store.ErrBanNotFound) {
+		t.Errorf("lifting another room's ban: err = %v, want ErrBanNotFound", err)
+	}
+	if err := st.LiftBan(room.Id, "b1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.LiftBan(room.Id, "b1"); !errors.Is(err, store.ErrBanNotFound) {
+		t.Errorf("lifting twice: err = %v, want ErrBanNotFound", err)
+	}
+	if bans, _ := st.Bans(room.Id); !reflect.DeepEqual(bans, []model.Ban{second}) {
+		t.Errorf("bans after lifting = %+v", bans)
+	}
+}
+
+func TestEventsAfter(t *testing.T) {
+	st, _ := openStore(t)
+	room, _ := st.CreateRoom("a", testSeed("h1", 1), "", "")
+	other, _ := st.CreateRoom("b", testSeed("h2", 1), "", "")
+	if id, err := st.LastEventID(room.Id); err != nil || id != 0 {
+		t.Fatalf("empty outbox: last id = %d, %v", id, err)
+	}
+	var want []store.OutboxEvent
+	for _, payload := range []string{"one", "two", "three"} {
+		id, err := st.AppendEvent(room.Id, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.AppendEvent(other.Id, "elsewhere"); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, store.OutboxEvent{ID: id, Payload: payload})
+	}
+	if id, _ := st.LastEventID(room.Id); id != want[2].ID {
+		t.Errorf("last id = %d, want %d", id, want[2].ID)
+	}
+	if got, err := st.EventsAfter(room.Id, 0, 2); err != nil || !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("first page = %+v, %v, want %+v", got, err, want[:2])
+	}
+	if got, _ := st.EventsAfter(room.Id, want[1].ID, 2); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("second page = %+v, want %+v", got, want[2:])
+	}
+	if got, _ := st.EventsAfter(room.Id, want[2].ID, 2); len(got) != 0 {
+		t.Errorf("after the last id = %+v", got)
+	}
+
+	if err := st.dropEventsBefore(time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := st.EventsAfter(room.Id, 0, 10); len(got) != 3 {
+		t.Errorf("%d events left after dropping older ones, want all 3", len(got))
+	}
+	if err := st.dropEventsBefore(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{room.Id, other.Id} {
+		if got, _ := st.EventsAfter(id, 0, 10); len(got) != 0 {
+			t.Errorf("room %s keeps %+v after its events expired", id, got)
+		}
+	}
+}
+
+func TestPlayerIP(t *testing.T) {
+	st, _ := openStore(t)
+	room, _ := st.CreateRoom("a", testSeed("h1", 1), "", "")
+	if ip, err := st.PlayerIP(room.Id, "p1"); err != nil || ip != "" {
+		t.Fatalf("unseen player: ip = %q, %v", ip, err)
+	}
+	for _, ip := range []string{"203.0.113.7", "198.51.100.2"} {
+		if err := st.SetPlayerIP(room.Id, "p1", ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ip, _ := st.PlayerIP(room.Id, "p1"); ip != "198.51.100.2" {
+		t.Errorf("ip = %q, want the latest", ip)
+	}
+	if ip, _ := st.PlayerIP(room.Id, "p2"); ip != "" {
+		t.Errorf("another player's ip = %q", ip)
+	}
+}
+
+func TestSeedsAndCustomDice(t *testing.T) {
+	st, _ := openStore(t)
+	room, _ := st.CreateRoom("a", testSeed("h1", 1), "", "")
+	if err := st.RotateSeed(room.Id, testSeed("h2", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RotateSeed(room.Id, testSeed("h3", 3)); err != nil {
+		t.Fatal(err)
+	}
+	st.SaveCustomDie(room.Id, model.CustomDie{Name: "loc", Faces: []model.Face{{Label: "Head", Value: 1}}})
+	st.SaveCustomDie(room.Id, model.CustomDie{Name: "loc", Faces: []model.Face{{Label: "Arm", Value: 2}}})
+	st.SaveCustomDie(room.Id, model.CustomDie{Name: "hit", Faces: []model.Face{{Label: "Miss", Value: 0}}})
+
+	got, err := st.GetRoom(room.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, s := range got.Seeds {
+		hashes = append(hashes, s.Hash)
+	}
+	if !reflect.DeepEqual(hashes, []string{"h1", "h2", "h3"}) ||
+		!got.Seeds[0].Revealed || !got.Seeds[1].Revealed || got.Seeds[2].Revealed {
+		t.Errorf("seeds = %+v, want all but the newest revealed", got.Seeds)
+	}
+	if cur := got.CurrentSeed(); cur == nil || cur.Hash != "h3" {
+		t.Errorf("current seed = %+v, want h3", cur)
+	}
+	if len(got.CustomDice) != 2 || got.CustomDice[0].Name != "hit" || got.CustomDice[1].Faces[0].Label != "Arm" {
+		t.Errorf("custom dice = %+v, want hit and the saved-over loc", got.CustomDice)
+	}
+}
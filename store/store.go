@@ -8,10 +8,59 @@ import (
 // ErrRoomNotFound is returned when a room ID does not exist.
 var ErrRoomNotFound = errors.New("room not found")
 
+// ErrRollNotFound is returned when a room has no roll with the given Seq.
+var ErrRollNotFound = errors.New("roll not found")
+
+// ErrBanNotFound is returned when a room has no ban with the given ID.
+var ErrBanNotFound = errors.New("ban not found")
+
+// OutboxEvent is a live event in a room's outbox. Payload is opaque to the store.
+type OutboxEvent struct {
+	ID      int64
+	Payload string
+}
+
 // Store is the interface for all room persistence operations.
 // Swap the in-memory implementation for a database one without touching handlers.
 type Store interface {
-	CreateRoom(name string) (*model.Room, error)
+	// CreateRoom makes a room whose rolls are drawn from seed until it is
+	// rotated, or a room without provably fair rolls if seed is zero. gmKey is the hash of its GM's key, or empty for no GM, and
+	// passphrase is the hash of the passphrase to enter it, or empty for none.
+	CreateRoom(name string, seed model.ServerSeed, gmKey, passphrase string) (*model.Room, error)
 	GetRoom(id string) (*model.Room, error)
-	AddEntry(roomID string, entry model.LogEntry) error
+	// AddEntry records a roll and sets its Seq.
+	AddEntry(roomID string, entry *model.LogEntry) error
+	// AddEntryFor records the roll that roll makes for the Seq it will have,
+	// and returns it with its Seq set. roll may be called more than once, and
+	// an error from it is returned as it is.
+	AddEntryFor(roomID string, roll func(seq int64) (model.LogEntry, error)) (*model.LogEntry, error)
+	// RevealRoll makes the roll seq public, whoever it was for, and returns it.
+	RevealRoll(roomID string, seq int64) (*model.LogEntry, error)
+	// RecentRolls returns up to limit rolls with a Seq below before, newest
+	// first. A before of 0 starts from the newest roll.
+	RecentRolls(roomID string, before int64, limit int) ([]model.LogEntry, error)
+	// SaveCustomDie adds a custom die to a room, replacing any with the same name.
+	SaveCustomDie(roomID string, die model.CustomDie) error
+	// RotateSeed reveals the room's current seed and starts drawing from next.
+	RotateSeed(roomID string, next model.ServerSeed) error
+	// AddBan records a ban or kick in a room.
+	AddBan(roomID string, ban model.Ban) error
+	// Bans lists a room's bans and kicks, oldest first.
+	Bans(roomID string) ([]model.Ban, error)
+	// LiftBan removes the ban with banID from a room.
+	LiftBan(roomID, banID string) error
+	// AppendEvent adds a live event to the room's outbox and returns its id.
+	// Instances sharing the store read each other's events from the outbox.
+	// Ids only grow, and an event is not seen by EventsAfter before every
+	// event with a lower id is. Old events may be dropped.
+	AppendEvent(roomID, payload string) (int64, error)
+	// EventsAfter returns up to limit of the room's outbox events with an id
+	// above after, oldest first.
+	EventsAfter(roomID string, after int64, limit int) ([]OutboxEvent, error)
+	// LastEventID is the id of the newest event in the room's outbox, or 0.
+	LastEventID(roomID string) (int64, error)
+	// SetPlayerIP records the address a player last connected to the room from.
+	SetPlayerIP(roomID, playerID, ip string) error
+	// PlayerIP is the address last recorded for a player in the room, or "".
+	PlayerIP(roomID, playerID string) (string, error)
 }
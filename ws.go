@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"dice_room/dice"
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout bounds a single write to a WebSocket client.
+const wsWriteTimeout = 10 * time.Second
+
+// wsClientTimeout is how long a WebSocket client may stay silent before its
+// connection is taken for dead and closed, so that it stops counting as
+// present. app.js sends a presence message well within it, and browsers
+// answer the stream's pings too.
+const wsClientTimeout = 90 * time.Second
+
+// upgrader leaves the Origin check to wsHandler, which knows the host the
+// gateway was asked for.
+var upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+// wsRequest is a message from the client: a "roll", a "chat" message in Text,
+// or a "presence" heartbeat, which is answered with who is here.
+type wsRequest struct {
+	Type       string `json:"type"`
+	Text       string `json:"text"`
+	Expression string `json:"expr"`
+	Desc       string `json:"desc"`
+	ClientSeed string `json:"clientSeed"`
+	// Secret is honoured for the room's GM only.
+	Secret  bool `json:"secret"`
+	Whisper bool `json:"whisper"`
+}
+
+// wsWriter sends a room stream as one WebSocket text message per event.
+// Replies to the client's own messages share the connection, so writes are
+// serialised.
+type wsWriter struct {
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	roomID string
+}
+
+func (w *wsWriter) Event(ev Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return w.conn.WriteMessage(websocket.TextMessage, []byte(ev.Data))
+}
+
+// reject tells the client that one of its messages failed.
+func (w *wsWriter) reject(message string) {
+	ev, err := newEvent(model.RoomEvent{
+		Type:    model.EventError,
+		RoomID:  w.roomID,
+		Payload: model.ErrorPayload{Message: message},
+	})
+	if err == nil {
+		w.Event(ev)
+	}
+}
+
+// Start does nothing; WebSocket clients pick their own reconnect delay.
+func (w *wsWriter) Start(retry time.Duration) error {
+	return nil
+}
+
+func (w *wsWriter) Heartbeat() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// wsHandler is the two-way room connection. It streams the same events as
+// eventsHandler, including the Last-Event-ID style replay via ?after=, and
+// accepts rolls from the client.
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	// Browsers let any site open a WebSocket with our cookies attached.
+	if !s.sameOrigin(r) {
+		http.Error(w, "Cross-origin WebSocket refused", http.StatusForbidden)
+		return
+	}
+	room, err := s.store.GetRoom(roomID)
+	if err != nil {
+		if errors.Is(err, store.ErrRoomNotFound) {
+			http.Error(w, "Room not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !s.canEnter(r, room) {
+		http.Error(w, "Room is locked", http.StatusForbidden)
+		return
+	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid after", http.StatusBadRequest)
+		return
+	}
+	viewer, ok, err := s.admit(r, room)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You have been banned from this room", http.StatusForbidden)
+		return
+	}
+	client := s.limits.clientIP(r)
+
+	// Subscribe first, so a full room is refused with a plain HTTP error.
+	sub, err := s.broadcaster.Subscribe(roomID, viewer)
+	if err != nil {
+		tooManyRequests(w, roomFullRetry)
+		return
+	}
+	defer s.broadcaster.Unsubscribe(roomID, sub)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client.
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxAPIBody)
+	conn.SetReadDeadline(time.Now().Add(wsClientTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsClientTimeout))
+	})
+
+	replay, err := s.replayAfter(roomID, lastID)
+	if err != nil {
+		log.Printf("ws: replay: %v", err)
+		return
+	}
+	if viewer.Name != "" {
+		defer s.openStream(roomID, viewer, client)()
+	}
+
+	// The read loop ends the stream when the client goes away, and closing
+	// the connection once the stream ends unblocks the read loop.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	out := &wsWriter{conn: conn, roomID: roomID}
+	go func() {
+		defer cancel()
+		s.wsRead(conn, out, roomID, client, viewer)
+	}()
+	s.broadcaster.Stream(ctx, out, sub, replay, lastID)
+}
+
+// wsRead handles client messages until the connection fails or closes.
+func (s *Server) wsRead(conn *websocket.Conn, out *wsWriter, roomID, client string, viewer model.Viewer) {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsClientTimeout))
+		var req wsRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			out.reject("invalid JSON message")
+			continue
+		}
+		switch req.Type {
+		case "roll":
+			s.wsRoll(out, roomID, client, viewer, req)
+		case "chat":
+			s.wsChat(out, roomID, client, viewer, req)
+		case "presence":
+			s.wsPresence(out, roomID)
+		default:
+			out.reject("unknown message type " + req.Type)
+		}
+	}
+}
+
+// wsRoll rolls for the client exactly as the room form does. The roll reaches
+// the client, like everyone else, through the room's stream. The room is
+// loaded afresh so that a rotated seed or a new custom die is picked up.
+func (s *Server) wsRoll(out *wsWriter, roomID, client string, viewer model.Viewer, req wsRequest) {
+	if viewer.Name == "" {
+		out.reject("join the room before rolling")
+		return
+	}
+	if ok, wait := s.limits.allowRoll(client, roomID); !ok {
+		out.reject("too many rolls, try again in " + retryAfter(wait) + "s")
+		return
+	}
+	room, err := s.store.GetRoom(roomID)
+	if err != nil {
+		log.Printf("ws: load room: %v", err)
+		out.reject("could not load room")
+		return
+	}
+	if s.wsRemoved(out, roomID, client, viewer) {
+		return
+	}
+	expr := strings.TrimSpace(req.Expression)
+	if expr == "" {
+		expr = "d20"
+	}
+	entry, err := s.rollDice(room, viewer, expr, req.Desc, req.ClientSeed, rollVisibility(viewer, req.Secret, req.Whisper))
+	if err != nil {
+		if errors.Is(err, dice.ErrInvalidExpression) {
+			out.reject(err.Error())
+		} else {
+			log.Printf("ws: roll: %v", err)
+			out.reject("could not record roll")
+		}
+		return
+	}
+	s.broadcastEntry(room.Id, entry)
+}
+
+// wsRemoved reports, having told the client, whether the viewer has been
+// kicked or banned since they connected. The kick ends their streams, but on
+// another instance only once it has polled the room, and a message may come
+// in before then.
+func (s *Server) wsRemoved(out *wsWriter, roomID, client string, viewer model.Viewer) bool {
+	bans, err := s.roomBans(roomID)
+	if err != nil {
+		log.Printf("ws: load bans: %v", err)
+		out.reject("could not load room")
+		return true
+	}
+	if banned, kicked := barred(bans, viewer, client); banned || kicked {
+		out.reject("you have been removed from this room")
+		return true
+	}
+	return false
+}
+
+// wsChat says the client's message to the room. Chat shares the roll limits.
+func (s *Server) wsChat(out *wsWriter, roomID, client string, viewer model.Viewer, req wsRequest) {
+	if viewer.Name == "" {
+		out.reject("join the room before chatting")
+		return
+	}
+	if ok, wait := s.limits.allowRoll(client, roomID); !ok {
+		out.reject("too many messages, try again in " + retryAfter(wait) + "s")
+		return
+	}
+	if s.wsRemoved(out, roomID, client, viewer) {
+		return
+	}
+	if err := s.sendChat(roomID, viewer, req.Text); err != nil {
+		if errors.Is(err, errEmptyChat) {
+			out.reject(err.Error())
+		} else {
+			log.Printf("ws: chat: %v", err)
+			out.reject("could not send message")
+		}
+	}
+}
+
+// wsPresence answers a client's heartbeat with who is in the room, so its
+// list stays right even if it missed a join or leave.
+func (s *Server) wsPresence(out *wsWriter, roomID string) {
+	ev, err := newEvent(model.RoomEvent{
+		Type:    model.EventPresence,
+		RoomID:  roomID,
+		Payload: model.PresencePayload{Players: s.presence.Players(roomID)},
+	})
+	if err != nil {
+		log.Printf("ws: encode presence: %v", err)
+		return
+	}
+	out.Event(ev)
+}
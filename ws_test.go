@@ -0,0 +1,128 @@
+package main
+
+import (
+	"dice_room/dice"
+	"dice_room/model"
+	"dice_room/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialRoom opens a WebSocket to a room as the player in sess, or as someone
+// who has not joined if sess has no name.
+func dialRoom(t *testing.T, s *Server, ts *httptest.Server, roomID string, sess session) *websocket.Conn {
+	t.Helper()
+	header := http.Header{}
+	if sess.Name != "" {
+		rec := httptest.NewRecorder()
+		if err := s.setSession(rec, httptest.NewRequest("GET", "/room/"+roomID, nil), sess); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range rec.Result().Cookies() {
+			header.Add("Cookie", c.Name+"="+c.Value)
+		}
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/"+roomID, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// wsEvent is a room event as a client receives it.
+type wsEvent struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// readEvent reads events from conn until one of type kind arrives.
+func readEvent(t *testing.T, conn *websocket.Conn, kind string) json.RawMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var ev wsEvent
+		if err := conn.ReadJSON(&ev); err != nil {
+			t.Fatalf("waiting for %s: %v", kind, err)
+		}
+		if ev.Type == kind {
+			return ev.Payload
+		}
+	}
+}
+
+func send(t *testing.T, conn *websocket.Conn, msg string) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebSocketChatAndPresence(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := testServer(st)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	room, err := st.CreateRoom("r", dice.NewServerSeed(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann := dialRoom(t, s, ts, room.Id, session{Room: room.Id, Player: "p1", Name: "ann"})
+	bob := dialRoom(t, s, ts, room.Id, session{Room: room.Id, Player: "p2", Name: "bob"})
+	// Both are in once ann has seen bob join.
+	for {
+		var p model.PresencePayload
+		json.Unmarshal(readEvent(t, ann, model.EventJoin), &p)
+		if p.User == "bob" {
+			break
+		}
+	}
+
+	send(t, ann, `{"type":"chat","text":"  hello  "}`)
+	var chat model.ChatPayload
+	if err := json.Unmarshal(readEvent(t, bob, model.EventChat), &chat); err != nil {
+		t.Fatal(err)
+	}
+	if chat.User != "ann" || chat.Text != "hello" || chat.Time == "" {
+		t.Errorf("bob got chat %+v, want ann saying hello", chat)
+	}
+
+	send(t, ann, `{"type":"presence"}`)
+	var here model.PresencePayload
+	if err := json.Unmarshal(readEvent(t, ann, model.EventPresence), &here); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(here.Players, []string{"ann", "bob"}) {
+		t.Errorf("presence answered with %v, want ann and bob", here.Players)
+	}
+
+	send(t, ann, `{"type":"chat","text":"   "}`)
+	readEvent(t, ann, model.EventError)
+	anon := dialRoom(t, s, ts, room.Id, session{})
+	send(t, anon, `{"type":"chat","text":"hi"}`)
+	var rejected model.ErrorPayload
+	json.Unmarshal(readEvent(t, anon, model.EventError), &rejected)
+	if !strings.Contains(rejected.Message, "join") {
+		t.Errorf("chat before joining: %q", rejected.Message)
+	}
+}
+
+func TestCleanChat(t *testing.T) {
+	long := strings.Repeat("é", maxChatLength+10)
+	for in, want := range map[string]string{
+		"  hi there ": "hi there",
+		"":            "",
+		long:          long[:maxChatLength*len("é")],
+	} {
+		if got := cleanChat(in); got != want {
+			t.Errorf("cleanChat(%.20q) = %.20q, want %.20q", in, got, want)
+		}
+	}
+}